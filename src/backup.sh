@@ -1,30 +1,1042 @@
 #!/bin/sh
 
-BACKUP_FILE="/misskey-data/backups/${POSTGRES_DB}_$(TZ='Asia/Tokyo' date +%Y-%m-%d_%H-%M).sql"
-COMPRESSED="${BACKUP_FILE}.7z"
+# 通知・ログの文言
+. /root/messages.sh
+# 通知の送信
+. /root/notify.sh
+# 保存先の設定
+. /root/storage.sh
+# 実行結果の書き出し
+. /root/result.sh
+NOTIFY_EVENT=backup
 
-pg_dump -h $POSTGRES_HOST -U $POSTGRES_USER -d $POSTGRES_DB > $BACKUP_FILE 2>> /var/log/cron.log
+# ダンプや実行ログには機密情報が含まれるため、作成するファイルは所有者のみ読み書きできるようにする
+umask 077
 
-7z a $COMPRESSED $BACKUP_FILE
+# 今回の実行ログへ書き込む
+log() {
+    echo "$(date -u +%Y-%m-%dT%H:%M:%SZ) $*" >> $RUN_LOG
+}
 
-rclone copy --s3-upload-cutoff=5000M --multi-thread-cutoff 5000M $COMPRESSED backup:${R2_PREFIX}
+# NOTIFY_SUCCESSに従い、今回の成功を通知するか判定する
+#   always:   毎回通知する (既定)
+#   daily:    1日1回だけ通知する
+#   recovery: 失敗後の最初の成功のみ通知する
+should_notify_success() {
+    case "${NOTIFY_SUCCESS:-always}" in
+        daily)
+            TODAY=$(TZ="${BACKUP_TZ:-UTC}" date +%Y-%m-%d)
+            [ "$(cat ${STATE_DIR}/last_success_notified 2> /dev/null)" != "$TODAY" ] || return 1
+            echo $TODAY > ${STATE_DIR}/last_success_notified
+            ;;
+        recovery)
+            [ -s ${STATE_DIR}/consecutive_failures ]
+            ;;
+    esac
+}
 
-# 成功確認
-if [ $? -eq 0 ]; then
-    echo "Backup succeeded" >> /var/log/cron.log
-    # 成功通知
+# 連続失敗回数を1つ増やす (再試行で失敗した回も数える)
+record_failure() {
+    FAILURES=$(( $(cat ${STATE_DIR}/consecutive_failures 2> /dev/null || echo 0) + 1 ))
+    echo $FAILURES > ${STATE_DIR}/consecutive_failures
+}
+
+# 連続失敗回数がしきい値に達したらGitHub/Giteaにissueを作成する
+# 再試行の途中でしきい値を超えることがあるため、成功するまでに作成するのは1回だけにする
+open_failure_issue() {
+    if [ -z "$ISSUE_REPO" ] || [ "$FAILURES" -lt "${ISSUE_FAILURE_THRESHOLD:-3}" ] \
+        || [ -f ${STATE_DIR}/failure_issue_opened ]; then
+        return
+    fi
+
+    PAYLOAD=$(jq -n \
+        --arg title "$(msg issue_title "$FAILED" "$FAILURES")" \
+        --arg body "$(msg issue_body "$FAILURES" "$(tail -n 50 $RUN_LOG)")" \
+        '{title: $title, body: $body}')
+    curl -sf -X POST -H "Authorization: token ${ISSUE_TOKEN}" -H "Content-Type: application/json" \
+        -d "$PAYLOAD" "${ISSUE_API_URL:-https://api.github.com}/repos/${ISSUE_REPO}/issues" > /dev/null 2>&1 \
+        && touch ${STATE_DIR}/failure_issue_opened
+}
+
+# 圧縮したファイルの一覧を出力する (SPLIT_SIZE指定時は分割された全ボリューム)
+artifacts() {
+    ls $1 $1.[0-9][0-9][0-9] 2> /dev/null
+}
+
+# 圧縮したファイルの合計サイズを出力する
+artifacts_size() {
+    stat -c %s $(artifacts $1) | awk '{ total += $1 } END { print total }'
+}
+
+# BACKUP_DEADLINEまでの残り時間の範囲でコマンドを実行する (過ぎた場合は打ち切って失敗とする)
+# 停止シグナルを受けたときにすぐ中断できるよう、バックグラウンドで実行して終了を待つ
+within_window() {
+    if [ -n "$DEADLINE" ]; then
+        REMAINING=$(( DEADLINE - $(date +%s) ))
+        [ $REMAINING -gt 0 ] || return 1
+        set -- timeout $REMAINING "$@"
+    fi
+    # バックグラウンドのコマンドは標準入力が/dev/nullになるため、パイプからの入力を引き継ぐ
+    exec 3<&0
+    "$@" <&3 3<&- &
+    CHILD=$!
+    wait $CHILD
+    CHILD_STATUS=$?
+    CHILD=""
+    exec 3<&-
+    return $CHILD_STATUS
+}
+
+# BACKUP_DEADLINEを過ぎた転送をrcloneに打ち切らせるフラグを出力する
+# (打ち切られたマルチパートアップロードは中止される)
+window_flags() {
+    [ -n "$DEADLINE" ] || return 0
+    REMAINING=$(( DEADLINE - $(date +%s) ))
+    echo "--max-duration $(( REMAINING > 0 ? REMAINING : 1 ))s --cutoff-mode hard"
+}
+
+# 保存先がオブジェクトのメタデータに対応していれば、ラベルとSHA-256を記録するヘッダーを出力する
+metadata_flags() {
+    [ -n "$METADATA_HEADER" ] || return 0
+    [ -n "$BACKUP_LABEL" ] && echo "--header-upload ${METADATA_HEADER}Label:${BACKUP_LABEL}"
+    echo "--header-upload ${METADATA_HEADER}Sha256:$(sha256sum $1 | cut -d ' ' -f 1)"
+}
+
+# 圧縮したファイルをアップロードし、それぞれのサイズを確認する
+# SHA-256はオブジェクトのメタデータにも記録し、ダウンロード時に照合できるようにする
+upload_artifacts() {
+    for ARTIFACT in $(artifacts $1); do
+        within_window rclone copy $UPLOAD_FLAGS $(window_flags) $(metadata_flags $ARTIFACT) \
+            $ARTIFACT backup:${R2_PREFIX}/${OBJECT_DIR} >> $RUN_LOG 2>&1 \
+            && verify_upload $ARTIFACT \
+            || return 1
+    done
+}
+
+# PARITY_PERCENTが設定されている場合、PAR2形式のパリティを作成してアップロードする
+# 保存先でバックアップが部分的に破損しても、復元時に修復できるようにするため
+upload_parity() {
+    [ -n "$PARITY_PERCENT" ] || return 0
+    par2 create -q -r${PARITY_PERCENT} $1.par2 $(artifacts $1) >> $RUN_LOG 2>&1 || return 1
+    for PARITY in $1*.par2; do
+        rclone copy $PARITY backup:${R2_PREFIX}/${OBJECT_DIR} >> $RUN_LOG 2>&1 || return 1
+    done
+}
+
+# アップロード済みオブジェクトのサイズがローカルのファイルと一致するか確認する
+# 一致しない場合、不完全なアップロードとして失敗扱いにする
+verify_upload() {
+    LOCAL_SIZE=$(stat -c %s $1)
+    REMOTE_SIZE=$(rclone lsf --format s backup:${R2_PREFIX}/${OBJECT_DIR}$(basename $1) 2>> $RUN_LOG)
+    if [ "$REMOTE_SIZE" != "$LOCAL_SIZE" ]; then
+        log "$(msg log_upload_size_mismatch "$(basename $1)" "$LOCAL_SIZE" "$REMOTE_SIZE")"
+        return 1
+    fi
+}
+
+# ENCRYPTION_MODE=ageの場合、圧縮したファイルをAGE_RECIPIENTの公開鍵で暗号化し(<名前>.age)、元のファイルを削除する
+# 復号に必要な秘密鍵はバックアップを取るホストに置かない
+encrypt_archive() {
+    [ "$ENCRYPTION_MODE" = "age" ] || return 0
+    age -r "$AGE_RECIPIENT" -o $1.age $1 >> $RUN_LOG 2>&1 || return 1
+    rm -f $1
+}
+
+# アップロード済みのバックアップを読み戻し、アーカイブとハッシュ値を検証する
+# (暗号化している場合は秘密鍵がないためアーカイブの検査は行わず、ハッシュ値のみ照合する)
+verify_remote_archive() {
+    case "$1" in
+        *.age) ;;
+        *) 7z t $(artifacts $1 | head -n 1) >> $RUN_LOG 2>&1 || return 1 ;;
+    esac
+    for ARTIFACT in $(artifacts $1); do
+        LOCAL_SHA256=$(sha256sum $ARTIFACT | cut -d ' ' -f 1)
+        REMOTE_SHA256=$(rclone cat backup:${R2_PREFIX}/${OBJECT_DIR}$(basename $ARTIFACT) 2>> $RUN_LOG | sha256sum | cut -d ' ' -f 1)
+        if [ "$REMOTE_SHA256" != "$LOCAL_SHA256" ]; then
+            log "$(msg log_checksum_mismatch "$(basename $ARTIFACT)")"
+            return 1
+        fi
+    done
+}
+
+# 失敗した実行でストレージに残ったオブジェクトをfailed/へ隔離する
+# 不完全なオブジェクトが復元可能なバックアップとして一覧に並ばないようにするため
+quarantine_upload() {
+    for ARTIFACT in $(artifacts $1); do
+        NAME=$(basename $ARTIFACT)
+        if [ -n "$(rclone lsf backup:${R2_PREFIX}/${OBJECT_DIR}${NAME} 2> /dev/null)" ]; then
+            rclone moveto backup:${R2_PREFIX}/${OBJECT_DIR}${NAME} backup:${R2_PREFIX}/failed/${NAME} >> $RUN_LOG 2>&1
+            log "$(msg log_quarantined "$NAME")"
+        fi
+    done
+}
+
+# スケジュール・保持期間・保存先などの設定を前回の実行と比較し、変わっていれば差分を通知する
+# (秘密情報は含めない)
+check_config_drift() {
+    CONFIG_FILE="${STATE_DIR}/config${SCHEDULE:+-${SCHEDULE}}"
+    {
+        grep -v '^#' /var/spool/cron/crontabs/root 2> /dev/null | sed '/^$/d' | sed 's/^/cron: /'
+        for VAR in POSTGRES_DBS POSTGRES_DB R2_PREFIX RCLONE_CONFIG_BACKUP_ENDPOINT \
+            BACKUP_RETENTION_DAYS BACKUP_RETENTION_COUNT FILES_DIR FILES_BACKUP_MODE \
+            PG_DUMP_FORMAT SPLIT_SIZE PARITY_PERCENT NOTIFY_SUCCESS; do
+            eval "echo \"${VAR}=\${${VAR}}\""
+        done
+    } > ${CONFIG_FILE}.new
+
+    if [ -f $CONFIG_FILE ] && ! cmp -s $CONFIG_FILE ${CONFIG_FILE}.new; then
+        DRIFT=$(diff -u $CONFIG_FILE ${CONFIG_FILE}.new | grep '^[-+][^-+]')
+        log "$(msg log_config_changed "$DRIFT")"
+        if [ -n "$NOTIFICATION" ]; then
+            notify info "$(msg notify_config_changed "$DRIFT")"
+        fi
+    fi
+    mv ${CONFIG_FILE}.new $CONFIG_FILE
+}
+
+# Prometheus形式のメトリクスを書き出す
+# node_exporterのtextfile collector、またはMETRICS_PORTのHTTPサーバーから参照する
+write_metrics() {
+    METRICS_FILE="/misskey-data/metrics/metrics.prom"
+    mkdir -p -m 755 $(dirname $METRICS_FILE)
+
+    # 成功/失敗回数と最終成功時刻は実行をまたいで保持する
+    COUNTER_FILE="${STATE_DIR}/${1}_total"
+    echo $(( $(cat $COUNTER_FILE 2> /dev/null || echo 0) + 1 )) > $COUNTER_FILE
+    if [ "$1" = "success" ]; then
+        date +%s > ${STATE_DIR}/last_success
+        # ファイルのバックアップだけを再試行した場合は、前回のデータベースのサイズを残す
+        [ $TOTAL_SIZE -eq 0 ] || echo $TOTAL_SIZE > ${STATE_DIR}/last_size
+    fi
+    # 定期レポート(summary.sh)用に実行ごとの結果を記録し、90日より古いものは捨てる
+    # 形式: 終了時刻;結果;サイズ;所要時間(秒)
+    echo "$(date +%s);$1;$TOTAL_SIZE;$(( $(date +%s) - START_TIME ))" >> ${STATE_DIR}/history
+    awk -F ';' -v since=$(( $(date +%s) - 90 * 86400 )) '$1 >= since' ${STATE_DIR}/history > ${STATE_DIR}/history.tmp \
+        && mv ${STATE_DIR}/history.tmp ${STATE_DIR}/history
+
+    cat <<EOF > ${METRICS_FILE}.tmp
+# HELP misskey_backup_last_success_timestamp_seconds Unix time of the last successful backup.
+# TYPE misskey_backup_last_success_timestamp_seconds gauge
+misskey_backup_last_success_timestamp_seconds $(cat ${STATE_DIR}/last_success 2> /dev/null || echo 0)
+# HELP misskey_backup_last_run_timestamp_seconds Unix time the last backup run finished.
+# TYPE misskey_backup_last_run_timestamp_seconds gauge
+misskey_backup_last_run_timestamp_seconds $(date +%s)
+# HELP misskey_backup_last_duration_seconds Duration of the last backup run.
+# TYPE misskey_backup_last_duration_seconds gauge
+misskey_backup_last_duration_seconds $(( $(date +%s) - START_TIME ))
+# HELP misskey_backup_last_size_bytes Size of the last successfully uploaded backup.
+# TYPE misskey_backup_last_size_bytes gauge
+misskey_backup_last_size_bytes $(cat ${STATE_DIR}/last_size 2> /dev/null || echo 0)
+# HELP misskey_backup_success_total Number of successful backup runs.
+# TYPE misskey_backup_success_total counter
+misskey_backup_success_total $(cat ${STATE_DIR}/success_total 2> /dev/null || echo 0)
+# HELP misskey_backup_failure_total Number of failed backup runs.
+# TYPE misskey_backup_failure_total counter
+misskey_backup_failure_total $(cat ${STATE_DIR}/failure_total 2> /dev/null || echo 0)
+EOF
+    # umask 077 のままでは、別のユーザーで動くnode_exporterがホストのマウント越しに読めないため、
+    # ディレクトリとともに読み取りを許可する
+    # (メトリクスに機密情報は含まない)
+    chmod 644 ${METRICS_FILE}.tmp
+    mv ${METRICS_FILE}.tmp $METRICS_FILE
+}
+
+# ポインタ$1を更新前の内容$2に戻す (更新前に存在しなかった場合は削除する)
+rollback_pointer() {
+    if [ -n "$2" ]; then
+        echo "$2" | rclone rcat backup:${R2_PREFIX}/$1 >> $RUN_LOG 2>&1
+    else
+        rclone deletefile backup:${R2_PREFIX}/$1 >> $RUN_LOG 2>&1
+    fi
+}
+
+# バックアップごとのマニフェスト(<バックアップ名>.sql.manifest.json)をアップロードし、
+# 同じ内容でポインタ(latest-<DB名>.json)を更新する
+# 最初のデータベースのものはlatest.jsonにも書き込む。分割した場合は全ボリュームをpartsに列挙する
+write_latest() {
+    PARTS=$(for ARTIFACT in $(artifacts $COMPRESSED); do
+        jq -n \
+            --arg name "${OBJECT_DIR}$(basename $ARTIFACT)" \
+            --arg sha256 "$(sha256sum $ARTIFACT | cut -d ' ' -f 1)" \
+            --argjson size "$(stat -c %s $ARTIFACT)" \
+            '{name: $name, sha256: $sha256, size: $size}'
+    done | jq -s .)
+    LATEST=$(jq -n \
+        --argjson parts "$PARTS" \
+        --arg database "$DB" \
+        --arg created_at "$(date -u +%Y-%m-%dT%H:%M:%SZ)" \
+        --arg backup_label "$BACKUP_LABEL" \
+        --arg wal_start_lsn "$WAL_START_LSN" \
+        --arg wal_end_lsn "$WAL_END_LSN" \
+        --arg wal_timeline "$WAL_TIMELINE" \
+        --arg dump_sha256 "$([ -f $BACKUP_FILE ] && sha256sum $BACKUP_FILE | cut -d ' ' -f 1)" \
+        --arg dump_size "$(find $BACKUP_FILE -type f -exec stat -c %s {} + | awk '{ total += $1 } END { print total }')" \
+        --arg pg_dump_version "$(pg_dump --version)" \
+        --arg encryption "$ENCRYPTION_MODE" \
+        '{manifest_version: 1,
+          name: $parts[0].name, sha256: (if ($parts | length) == 1 then $parts[0].sha256 else null end),
+          size: ([$parts[].size] | add), parts: $parts, database: $database, created_at: $created_at,
+          dump: {
+            sha256: (if $dump_sha256 == "" then null else $dump_sha256 end),
+            size: ($dump_size | tonumber? // null),
+            pg_dump_version: $pg_dump_version
+          },
+          encryption: (if $encryption == "" then null else $encryption end),
+          label: (if $backup_label == "" then null else $backup_label end),
+          wal: {
+            start_lsn: (if $wal_start_lsn == "" then null else $wal_start_lsn end),
+            end_lsn: (if $wal_end_lsn == "" then null else $wal_end_lsn end),
+            timeline: ($wal_timeline | tonumber? // null)
+          }}')
+    # verify.sh・restore.shが参照するため、書き込めなかった場合はバックアップの失敗とする
+    # (隔離したバックアップが一覧に並ばないよう、マニフェストも削除する)
+    MANIFEST_OBJECT="backup:${R2_PREFIX}/${OBJECT_DIR}$(basename $BACKUP_FILE).manifest.json"
+    PREVIOUS_DB_POINTER=$(rclone cat backup:${R2_PREFIX}/latest-${DB}.json 2> /dev/null)
+    [ "$DB" != "$PRIMARY_DB" ] || PREVIOUS_POINTER=$(rclone cat backup:${R2_PREFIX}/latest.json 2> /dev/null)
+    if ! { echo "$LATEST" | rclone rcat $MANIFEST_OBJECT >> $RUN_LOG 2>&1 \
+        && echo "$LATEST" | rclone rcat backup:${R2_PREFIX}/latest-${DB}.json >> $RUN_LOG 2>&1 \
+        && { [ "$DB" != "$PRIMARY_DB" ] || echo "$LATEST" | rclone rcat backup:${R2_PREFIX}/latest.json >> $RUN_LOG 2>&1; }; }; then
+        log "$(msg log_latest_failed "$DB")"
+        rclone deletefile $MANIFEST_OBJECT >> $RUN_LOG 2>&1
+        # 一部のポインタだけが隔離したバックアップを指したままにならないよう、更新前の内容に戻す
+        rollback_pointer latest-${DB}.json "$PREVIOUS_DB_POINTER"
+        [ "$DB" != "$PRIMARY_DB" ] || rollback_pointer latest.json "$PREVIOUS_POINTER"
+        return 1
+    fi
+    RESULT_PARTS="${RESULT_PARTS}${PARTS}"
+}
+
+# 保持期間・保持数を超えた古いバックアップを削除する
+# BACKUP_RETENTION_DAYS日以内のもの、または新しい順にBACKUP_RETENTION_COUNT個までのものを残す
+# (両方設定した場合はどちらかを満たせば残す。種類ごとの最新のバックアップは常に残す)
+# pinned/ と failed/ 以下は対象外 (--scheduleを指定した場合はそのスケジュールの<名前>/以下のみが対象)
+cleanup_old_backups() {
+    [ -n "$BACKUP_RETENTION_DAYS" ] || [ -n "$BACKUP_RETENTION_COUNT" ] || return 0
+    CUTOFF=$(date -u -d "@$(( $(date +%s) - ${BACKUP_RETENTION_DAYS:-0} * 86400 ))" '+%Y-%m-%d %H:%M:%S')
+
+    # 件数・最新の判定には、アーカイブの残っているバックアップだけを数える
+    # 失敗した実行の実行ログだけが残ったものは、保持しているバックアップより古くなったら削除する
+    RETENTION_DIR="${SCHEDULE:+${SCHEDULE}/}"
+    list_backups ${RETENTION_DIR} \
+        | awk -F ';' -v days="$BACKUP_RETENTION_DAYS" -v count="$BACKUP_RETENTION_COUNT" -v cutoff="$CUTOFF" '{
+            if ($5) {
+                n[$2]++
+                if (n[$2] == 1 || (count != "" && n[$2] <= count) || (days != "" && $1 >= cutoff)) next
+            } else {
+                if (!n[$2] || (count != "" && n[$2] < count) || (days != "" && $1 >= cutoff)) next
+            }
+            print $3
+        }' \
+        | while read BASE; do
+            rclone delete --max-depth 1 --include "${BASE}.*" backup:${R2_PREFIX}/${RETENTION_DIR} >> $RUN_LOG 2>&1
+            log "$(msg log_retention_deleted "$BASE")"
+        done
+}
+
+# failed/ へ隔離したオブジェクトを、調査できるよう保持期間(BACKUP_RETENTION_DAYS、未設定時は7日)の間だけ残して削除する
+cleanup_quarantine() {
+    rclone delete --min-age ${BACKUP_RETENTION_DAYS:-7}d backup:${R2_PREFIX}/failed >> $RUN_LOG 2>&1
+}
+
+# 保存先のディレクトリ$1にあるバックアップを、新しい順に1行ずつ「更新時刻;種類;名前;サイズ;完全か」で出力する
+# 分割ボリューム・パリティ・実行ログ・マニフェストをまとめて1つのバックアップとして扱い、最も新しい更新時刻を使う
+# アーカイブ (.sql.7z* / .tar.7z*) かマニフェストがあるものを完全(1)、実行ログしかないものを不完全(空)とする
+list_backups() {
+    TZ=UTC rclone lsf --files-only --format tsp --separator ';' backup:${R2_PREFIX}/$1 2>> $RUN_LOG \
+        | awk -F ';' '{
+            base = $3
+            if (!sub(/\.(sql|tar)\..*$/, "", base)) next
+            kind = base
+            sub(/_[0-9][0-9][0-9][0-9]-[0-9][0-9]-[0-9][0-9].*$/, "", kind)
+            size[base] += $2; kinds[base] = kind
+            if ($1 > time[base]) time[base] = $1
+            if (substr($3, length(base) + 1) ~ /^\.(sql|tar)\.(7z|manifest\.json)/) complete[base] = 1
+        }
+        END { for (base in size) print time[base] ";" kinds[base] ";" base ";" size[base] ";" complete[base] }' \
+        | sort -r
+}
+
+# TIER_AFTER_DAYS日を過ぎたバックアップを、サーバー側のコピーでTIER_STORAGE_CLASSへ移す
+# 一覧や検証で読むマニフェストとlatest.jsonは移さない (pinned/ 以下も対象外)
+tier_old_backups() {
+    [ -n "$TIER_AFTER_DAYS" ] || return 0
+    TIER_DIR="${SCHEDULE:+${SCHEDULE}/}"
+    rclone settier $TIER_STORAGE_CLASS backup:${R2_PREFIX}/${TIER_DIR} \
+        --max-depth 1 --min-age ${TIER_AFTER_DAYS}d --exclude "*.json" >> $RUN_LOG 2>&1 \
+        || log "$(msg log_tier_failed "$TIER_STORAGE_CLASS")"
+}
+
+# 保存先の使用量を確認し、成功通知に含める文言(STORAGE_NOTICE)を用意する
+# R2_QUOTA_BYTESが設定されている場合は、QUOTA_WARN_PERCENT(%)を超えたときに警告し、
+# QUOTA_PRUNEが有効なら古いバックアップから削除して使用量を下げる
+check_storage_usage() {
+    USAGE=$(rclone size --json backup:${R2_PREFIX} 2>> $RUN_LOG | jq -r '.bytes // empty')
+    [ -n "$USAGE" ] || return 0
+    if [ -z "$R2_QUOTA_BYTES" ]; then
+        STORAGE_NOTICE=$(msg notify_storage_usage "$(human_size $USAGE)")
+        return 0
+    fi
+
+    LIMIT=$(( R2_QUOTA_BYTES * ${QUOTA_WARN_PERCENT:-90} / 100 ))
+    if [ $USAGE -gt $LIMIT ] && [ -n "$QUOTA_PRUNE" ]; then
+        prune_for_quota
+        USAGE=$(rclone size --json backup:${R2_PREFIX} 2>> $RUN_LOG | jq -r '.bytes // 0')
+    fi
+    STORAGE_NOTICE=$(msg notify_storage_quota "$(human_size $USAGE)" "$(human_size $R2_QUOTA_BYTES)" \
+        "$(( USAGE * 100 / R2_QUOTA_BYTES ))")
+    if [ $USAGE -gt $LIMIT ]; then
+        log "$(msg log_quota_exceeded "$USAGE" "$LIMIT")"
+        if [ -n "$NOTIFICATION" ]; then
+            notify failure "$(msg notify_quota_exceeded "${QUOTA_WARN_PERCENT:-90}")
+${STORAGE_NOTICE}"
+        fi
+    fi
+}
+
+# 使用量がLIMITを下回るまで、古いバックアップから削除する
+# 保持期間による削除と同じく、種類ごとの最新のバックアップと pinned/ 以下は残す
+# 削除できるものをすべて削除してもLIMITを下回らない場合は、何も削除せずに警告だけにする
+prune_for_quota() {
+    RETENTION_DIR="${SCHEDULE:+${SCHEDULE}/}"
+    CANDIDATES=$(list_backups ${RETENTION_DIR} | awk -F ';' '!($5 && !seen[$2]++)' | sort)
+    PRUNABLE=$(echo "$CANDIDATES" | awk -F ';' '{ sum += $4 } END { print sum + 0 }')
+    if [ $(( USAGE - PRUNABLE )) -gt $LIMIT ]; then
+        log "$(msg log_quota_prune_insufficient "$PRUNABLE" "$LIMIT")"
+        return 0
+    fi
+
+    echo "$CANDIDATES" | while IFS=';' read TIME KIND BASE SIZE COMPLETE; do
+        [ $USAGE -gt $LIMIT ] || break
+        rclone delete --max-depth 1 --include "${BASE}.*" backup:${R2_PREFIX}/${RETENTION_DIR} >> $RUN_LOG 2>&1
+        log "$(msg log_quota_pruned "$BASE")"
+        USAGE=$(( USAGE - SIZE ))
+    done
+}
+
+# ドライブファイルを差分同期する (FILES_BACKUP_MODE=sync)
+# files/current に最新の状態を保ち、変更・削除されたファイルは files/history/<時刻> へ退避する
+# 同期後のファイル一覧(更新時刻・サイズ・パス)を files/manifests/<時刻>.txt として保存する
+sync_files() {
+    FILES_REMOTE="backup:${R2_PREFIX}/files"
+    within_window rclone sync $UPLOAD_FLAGS $(window_flags) $FILES_DIR ${FILES_REMOTE}/current \
+        --backup-dir ${FILES_REMOTE}/history/${TIMESTAMP} >> $RUN_LOG 2>&1 \
+        && rclone lsf -R --files-only --format tsp --separator ';' ${FILES_REMOTE}/current 2>> $RUN_LOG \
+            | rclone rcat ${FILES_REMOTE}/manifests/${TIMESTAMP}.txt >> $RUN_LOG 2>&1 \
+        || return 1
+
+    # 保持期間を過ぎた退避ファイルを削除する
+    # 退避したファイルの更新時刻は元のファイルのままのため、退避した時刻(ディレクトリ名)で判定する
+    if [ -n "$BACKUP_RETENTION_DAYS" ]; then
+        CUTOFF=$(TZ="${BACKUP_TZ:-UTC}" date -d "@$(( $(date +%s) - BACKUP_RETENTION_DAYS * 86400 ))" +%Y-%m-%dT%H-%M-%S)
+        rclone lsf --dirs-only ${FILES_REMOTE}/history 2>> $RUN_LOG \
+            | awk -v cutoff="$CUTOFF" 'substr($0, 1, 19) < cutoff' \
+            | while read DIR; do
+                rclone purge ${FILES_REMOTE}/history/${DIR%/} >> $RUN_LOG 2>&1
+            done
+    fi
+}
+
+# HEALTHCHECK_URL (Healthchecks.ioなど) へ実行状況を送信する
+# コンテナ自体が停止して失敗通知すら届かない場合も、外部の監視で検知できるようにするため
+ping_healthcheck() {
+    [ -n "$HEALTHCHECK_URL" ] || return 0
+    tail -n 50 $RUN_LOG 2> /dev/null \
+        | curl -fsS -m 10 --retry 3 --data-binary @- "${HEALTHCHECK_URL}${1}" > /dev/null 2>&1
+}
+
+# バックアップ中のデータベース($DB)でSQLを実行し、結果のみを出力する
+pg_query() {
+    psql -h $POSTGRES_HOST -U $POSTGRES_USER -d $DB -Atc "$1" 2>> $RUN_LOG
+}
+
+# ダンプの前に、ステージング領域の空き容量が足りるか確認する
+# データベースのサイズ(pg_database_size)にDISK_SPACE_FACTOR(%)を掛けた量を必要量とみなす
+check_disk_space() {
+    REQUIRED=$(( $(pg_query "SELECT pg_database_size(current_database())" || echo 0) * ${DISK_SPACE_FACTOR:-100} / 100 ))
+    AVAILABLE=$(( $(df -Pk /misskey-data/backups | awk 'NR == 2 { print $4 }') * 1024 ))
+    [ $AVAILABLE -ge $REQUIRED ]
+}
+
+# 停止シグナル(SIGTERM/SIGINT)を受けた場合に、実行中の処理を止めて後片付けをし、中断を通知する
+# アップロード途中のマルチパートアップロードはrcloneの終了時と次回実行時の掃除で中止される
+on_interrupt() {
+    trap '' TERM INT
+    if [ -n "$CHILD" ]; then
+        kill $CHILD 2> /dev/null
+        wait $CHILD
+    fi
+    if [ -n "$FILES_TAR" ]; then
+        kill $FILES_TAR 2> /dev/null
+    fi
+    STATUS=1
+    FAILED="${FAILED:+${FAILED}, }${DB}"
+    log "$(msg log_interrupted)"
+    for ARCHIVE in $COMPRESSED $FILES_ARCHIVE; do
+        quarantine_upload $ARCHIVE
+        rm -rf ${ARCHIVE%.age} $(artifacts $ARCHIVE) ${ARCHIVE}*.par2 ${ARCHIVE}.fifo
+    done
+    rm -rf $BACKUP_FILE $DUMP_ERROR
+    write_metrics failure
+    write_backup_result
+    if [ -n "$NOTIFICATION" ]; then
+        notify failure "$(msg notify_interrupted "${DB:-$PRIMARY_DB}")"
+    fi
+    cat $RUN_LOG >> /var/log/cron.log
+    ping_healthcheck /fail
+    rm -rf $RUN_LOG
+    exit 143
+}
+
+# 30s・10m・1hのような時間を秒数に変換する (単位がなければ秒)
+duration_seconds() {
+    case "$1" in
+        *h) echo $(( ${1%h} * 3600 )) ;;
+        *m) echo $(( ${1%m} * 60 )) ;;
+        *) echo ${1%s} ;;
+    esac
+}
+
+# RETRY_DELAYS (例: "10m 30m 1h") に従い、失敗した実行を再試行するまでの秒数を出力する
+# 再試行を使い切った場合や、BACKUP_DEADLINEまでに再試行を始められない場合は何も出力しない
+next_retry_delay() {
+    set -- $RETRY_DELAYS
+    [ ${RETRY_ATTEMPT:-0} -lt $# ] || return 0
+    shift ${RETRY_ATTEMPT:-0}
+    DELAY=$(duration_seconds $1)
+    if [ -n "$DEADLINE" ] && [ $(( $(date +%s) + DELAY )) -ge $DEADLINE ]; then
+        return 0
+    fi
+    echo $DELAY
+}
+
+# 設定の問題をCONFIG_ERRORSに追加する
+config_error() {
+    CONFIG_ERRORS="${CONFIG_ERRORS}$1
+"
+}
+
+# 変数$1の値が空白区切りの選択肢$2のいずれかであることを確認する
+check_choice() {
+    eval "VALUE=\${${1}}"
+    [ -z "$VALUE" ] || echo " $2 " | grep -q " $VALUE " || config_error "$(msg config_invalid_choice "$1" "$2" "$VALUE")"
+}
+
+# 設定を検証し、問題をまとめてCONFIG_ERRORSに出力する
+# 実行の途中で失敗するのではなく、開始時にすべての問題を一度に知らせるため
+validate_config() {
+    CONFIG_ERRORS=""
+
+    for VAR in POSTGRES_HOST POSTGRES_USER R2_PREFIX; do
+        eval "VALUE=\${${VAR}}"
+        [ -n "$VALUE" ] || config_error "$(msg config_missing "$VAR")"
+    done
+    [ -n "${POSTGRES_DBS:-$POSTGRES_DB}" ] || config_error "$(msg config_missing "POSTGRES_DB")"
+
+    for VAR in BACKUP_RETENTION_DAYS BACKUP_RETENTION_COUNT PG_DUMP_JOBS UPLOAD_CONCURRENCY STAGING_MAX_AGE \
+        MULTIPART_MAX_AGE_DAYS DISK_SPACE_FACTOR ISSUE_FAILURE_THRESHOLD PG_WAIT_RETRIES PG_WAIT_INTERVAL \
+        R2_QUOTA_BYTES QUOTA_WARN_PERCENT LIFECYCLE_MARGIN_DAYS TIER_AFTER_DAYS COMPRESSION_THREADS BACKUP_QUEUE_TIMEOUT; do
+        eval "VALUE=\${${VAR}}"
+        case "$VALUE" in
+            ""|*[!0-9]*) [ -z "$VALUE" ] || config_error "$(msg config_not_integer "$VAR" "$VALUE")" ;;
+        esac
+    done
+    case "$BACKUP_DEADLINE" in
+        ""|[01][0-9]:[0-5][0-9]|2[0-3]:[0-5][0-9]) ;;
+        *) config_error "$(msg config_out_of_range "BACKUP_DEADLINE" "00:00-23:59" "$BACKUP_DEADLINE")" ;;
+    esac
+    if [ -n "$SCHEDULE_JITTER" ] && ! echo "$SCHEDULE_JITTER" | grep -qx '[0-9][0-9]*[smh]\{0,1\}'; then
+        config_error "$(msg config_invalid_duration "SCHEDULE_JITTER" "$SCHEDULE_JITTER")"
+    fi
+    for DELAY in $RETRY_DELAYS; do
+        echo "$DELAY" | grep -qx '[0-9][0-9]*[smh]\{0,1\}' \
+            || config_error "$(msg config_invalid_duration "RETRY_DELAYS" "$DELAY")"
+    done
+    case "$PARITY_PERCENT" in
+        ""|[1-9]|[1-9][0-9]|100) ;;
+        *) config_error "$(msg config_out_of_range "PARITY_PERCENT" "1-100" "$PARITY_PERCENT")" ;;
+    esac
+
+    check_choice PG_DUMP_FORMAT "plain custom directory"
+    check_choice FILES_BACKUP_MODE "archive sync"
+    check_choice NOTIFY_SUCCESS "always daily recovery"
+    check_choice MESSAGE_LANG "ja en"
+    check_choice ENCRYPTION_MODE "age"
+    check_choice STORAGE_BACKEND "s3 gcs webdav rclone"
+    if [ "$STORAGE_BACKEND" = "webdav" ]; then
+        [ -n "$WEBDAV_URL" ] || config_error "$(msg config_missing "WEBDAV_URL")"
+        [ -n "$WEBDAV_USER" ] || [ -n "$WEBDAV_BEARER_TOKEN" ] || config_error "$(msg config_missing "WEBDAV_USER")"
+    fi
+    if [ "$STORAGE_BACKEND" = "rclone" ]; then
+        [ -n "$RCLONE_REMOTE" ] || config_error "$(msg config_missing "RCLONE_REMOTE")"
+    fi
+    if [ -n "$GCS_SERVICE_ACCOUNT_FILE" ] && [ ! -r "$GCS_SERVICE_ACCOUNT_FILE" ]; then
+        config_error "$(msg config_not_file "GCS_SERVICE_ACCOUNT_FILE" "$GCS_SERVICE_ACCOUNT_FILE")"
+    fi
+    if [ "$ENCRYPTION_MODE" = "age" ]; then
+        [ -n "$AGE_RECIPIENT" ] || config_error "$(msg config_missing "AGE_RECIPIENT")"
+        # 分割したボリュームを個別に暗号化すると復元時に結合できないため、分割とは併用できない
+        [ -z "$SPLIT_SIZE" ] || config_error "$(msg config_conflict "SPLIT_SIZE" "ENCRYPTION_MODE=age")"
+    fi
+
+    if [ -n "$R2_QUOTA_BYTES" ] && [ "$R2_QUOTA_BYTES" -eq 0 ] 2> /dev/null; then
+        config_error "$(msg config_out_of_range "R2_QUOTA_BYTES" "1-" "$R2_QUOTA_BYTES")"
+    fi
+    if [ -n "$TIER_AFTER_DAYS" ]; then
+        [ -n "$TIER_STORAGE_CLASS" ] || config_error "$(msg config_missing "TIER_STORAGE_CLASS")"
+    fi
+
+    for VAR in DISCORD_WEBHOOK_URL NTFY_URL GOTIFY_URL WEBHOOK_URL HEALTHCHECK_URL ISSUE_API_URL WEBDAV_URL; do
+        eval "VALUE=\${${VAR}}"
+        case "$VALUE" in
+            ""|http://*|https://*) ;;
+            *) config_error "$(msg config_invalid_url "$VAR" "$VALUE")" ;;
+        esac
+    done
+    if [ -n "$NOTIFICATION" ] && [ -z "$(notifiers)" ]; then
+        config_error "$(msg config_no_notifier)"
+    fi
+    if [ -n "$FILES_DIR" ] && [ ! -d "$FILES_DIR" ]; then
+        config_error "$(msg config_not_directory "FILES_DIR" "$FILES_DIR")"
+    fi
+
+    [ -z "$CONFIG_ERRORS" ]
+}
+
+# 実行結果をRESULT_FILEに書き出す (result.shを参照)
+write_backup_result() {
+    write_result backup "$(jq -n \
+        --arg succeeded "$SUCCEEDED_DBS" \
+        --arg failed "$FAILED" \
+        --argjson artifacts "$(echo "$RESULT_PARTS" | jq -s 'add // []')" \
+        --arg backup_label "$BACKUP_LABEL" \
+        '{succeeded: ($succeeded | split(" ") | map(select(. != ""))),
+          failed: ($failed | split(", ") | map(select(. != ""))),
+          label: (if $backup_label == "" then null else $backup_label end), artifacts: $artifacts}')"
+}
+
+# Misskeyの設定ファイル(.config/default.yml)のdbセクションから値を読み出す
+misskey_db_value() {
+    awk -v key="$1" '
+        /^[^ #]/ { in_db = /^db:/; next }
+        in_db && $1 == key ":" {
+            sub(/^[^:]*:[ \t]*/, ""); sub(/[ \t]+#.*$/, ""); gsub(/^["\047]|["\047]$/, "")
+            print; exit
+        }' $MISSKEY_CONFIG
+}
+
+# Misskeyのdocker-composeと並べて動かす場合に、マウントした設定ファイルから接続情報を読み込む
+# 環境変数で指定されている値はそちらを優先し、ホストが分からない場合はMisskeyのcomposeのサービス名(db)を使う
+autodetect_misskey_config() {
+    MISSKEY_CONFIG=${MISSKEY_CONFIG:-/misskey/.config/default.yml}
+    if [ -f "$MISSKEY_CONFIG" ]; then
+        POSTGRES_HOST=${POSTGRES_HOST:-$(misskey_db_value host)}
+        POSTGRES_USER=${POSTGRES_USER:-$(misskey_db_value user)}
+        if [ -z "${POSTGRES_DBS:-$POSTGRES_DB}" ]; then
+            POSTGRES_DB=$(misskey_db_value db)
+        fi
+        export PGPORT=${PGPORT:-$(misskey_db_value port)}
+        export PGPASSWORD=${PGPASSWORD:-$(misskey_db_value pass)}
+    fi
+    POSTGRES_HOST=${POSTGRES_HOST:-db}
+}
+
+# Postgresが接続を受け付けるまで待つ
+# Misskeyと同時に起動した直後など、データベースの準備ができる前にダンプを始めないようにする
+wait_for_postgres() {
+    TRY=0
+    until pg_isready -q -h $POSTGRES_HOST -U $POSTGRES_USER; do
+        TRY=$(( TRY + 1 ))
+        if [ $TRY -ge ${PG_WAIT_RETRIES:-30} ]; then
+            log "$(msg log_postgres_unreachable "$POSTGRES_HOST")"
+            return 1
+        fi
+        sleep ${PG_WAIT_INTERVAL:-5}
+    done
+}
+
+# 引数の解釈
+# --label <名前>: バックアップにラベルを付ける (例: --label pre-upgrade-v2024.5)
+# --schedule <名前>: スケジュールごとに<名前>/以下へ保存し、<名前>_RETENTION_DAYS/COUNTの保持設定を使う
+#                   (例: --schedule daily で DAILY_RETENTION_DAYS、未設定ならBACKUP_RETENTION_DAYS)
+# --compose-autodetect: Misskeyの設定ファイルから接続情報を読み込む (COMPOSE_AUTODETECTでも有効になる)
+# pre-upgrade: アップグレード前のバックアップを取得する
+#              保持期間による削除の対象外(pinned/)に保存し、検証に成功した場合のみ終了コード0を返す
+# 再試行のときに同じ引数で実行し直すため保存しておく
+ARGS="$*"
+while [ $# -gt 0 ]; do
+    case "$1" in
+        pre-upgrade)
+            PRE_UPGRADE=true
+            ;;
+        --label)
+            BACKUP_LABEL=$2
+            shift
+            ;;
+        --schedule)
+            SCHEDULE=$2
+            shift
+            ;;
+        --compose-autodetect)
+            COMPOSE_AUTODETECT=true
+            ;;
+    esac
+    shift
+done
+if [ -n "$SCHEDULE" ]; then
+    SCHEDULE=$(printf %s "$SCHEDULE" | tr -c 'A-Za-z0-9_-' '-')
+    OBJECT_DIR="${SCHEDULE}/"
+    SCHEDULE_VAR=$(printf %s "$SCHEDULE" | tr 'a-z-' 'A-Z_')
+    eval "BACKUP_RETENTION_DAYS=\${${SCHEDULE_VAR}_RETENTION_DAYS:-\$BACKUP_RETENTION_DAYS}"
+    eval "BACKUP_RETENTION_COUNT=\${${SCHEDULE_VAR}_RETENTION_COUNT:-\$BACKUP_RETENTION_COUNT}"
+    # 通知にスケジュール名を付けて区別できるようにする
+    NOTIFY_TAG=$SCHEDULE
+fi
+if [ -n "$RETRY_ATTEMPT" ]; then
+    set -- $RETRY_DELAYS
+    NOTIFY_TAG="${NOTIFY_TAG:+${NOTIFY_TAG} }$(msg retry_attempt "$RETRY_ATTEMPT" "$#")"
+fi
+if [ -n "$PRE_UPGRADE" ]; then
+    BACKUP_LABEL=${BACKUP_LABEL:-pre-upgrade}
+    OBJECT_DIR="pinned/"
+fi
+# ラベルはファイル名・メタデータに使うため安全な文字に置き換える
+BACKUP_LABEL=$(printf %s "$BACKUP_LABEL" | tr -c 'A-Za-z0-9._-' '-')
+
+if [ -n "$COMPOSE_AUTODETECT" ]; then
+    autodetect_misskey_config
+fi
+
+if ! validate_config; then
+    printf "%s" "$CONFIG_ERRORS" >> /var/log/cron.log
+    if [ -n "$NOTIFICATION" ] && [ -n "$(notifiers)" ]; then
+        notify failure "$(msg notify_config_invalid "$CONFIG_ERRORS")"
+    fi
+    exit 1
+fi
+
+# 同じ時刻に設定した多数のインスタンスが一斉にPostgresと保存先へ負荷をかけないよう、
+# SCHEDULE_JITTER (例: 10m) の範囲でランダムに開始を遅らせる
+# (アップグレード前のバックアップと再試行は待たない)
+if [ -n "$SCHEDULE_JITTER" ] && [ -z "$PRE_UPGRADE" ] && [ -z "$RETRY_ATTEMPT" ]; then
+    JITTER=$(duration_seconds $SCHEDULE_JITTER)
+    sleep $(( $(od -An -tu4 -N4 /dev/urandom) % (JITTER + 1) ))
+fi
+
+START_TIME=$(date +%s)
+
+# ファイル名に使う時刻 (既定はUTC、秒精度・オフセット付き)
+TIMESTAMP=$(TZ="${BACKUP_TZ:-UTC}" date +%Y-%m-%dT%H-%M-%S%z)
+# 同一秒の実行でも衝突しないよう実行IDを付与する
+RUN_ID=$(head -c 4 /dev/urandom | od -An -tx1 | tr -d ' \n')
+
+# 実行をまたいで保持する状態の保存先
+STATE_DIR="/misskey-data/state"
+mkdir -p $STATE_DIR
+
+# 同じスケジュールの前回の実行が次の実行まで終わっていない場合は、ダンプを重複させないよう今回の実行を見送る
+# 別のスケジュールの実行中は、同時にダンプしないようBACKUP_QUEUE_TIMEOUT秒まで終わるのを待つ
+# (アップグレード前のバックアップは見送らず、実行中のものが終わるのを待つ)
+exec 8> ${STATE_DIR}/schedule${SCHEDULE:+-${SCHEDULE}}.lock
+exec 9> ${STATE_DIR}/backup.lock
+if [ -n "$PRE_UPGRADE" ]; then
+    flock 9
+elif ! flock -n 8; then
+    echo "$(msg log_backup_skipped_locked)" >> /var/log/cron.log
     if [ -n "$NOTIFICATION" ]; then
-        curl -X POST -F content="✅バックアップが完了しました。(${COMPRESSED})" ${DISCORD_WEBHOOK_URL} &> /dev/null
+        notify info "$(msg notify_backup_skipped_locked)"
+    fi
+    exit 0
+elif ! flock -w ${BACKUP_QUEUE_TIMEOUT:-21600} 9; then
+    echo "$(msg log_backup_skipped_queue "${BACKUP_QUEUE_TIMEOUT:-21600}")" >> /var/log/cron.log
+    if [ -n "$NOTIFICATION" ]; then
+        notify info "$(msg notify_backup_skipped_queue "${BACKUP_QUEUE_TIMEOUT:-21600}")"
+    fi
+    exit 0
+fi
+
+# バックアップ対象のデータベース (POSTGRES_DBSにカンマ区切りで複数指定できる)
+DATABASES=$(echo "${POSTGRES_DBS:-$POSTGRES_DB}" | tr ',' ' ')
+PRIMARY_DB=${DATABASES%% *}
+BACKUP_FILES=${FILES_DIR:+true}
+
+# 再試行では、前回失敗したデータベースとファイルのバックアップ(RETRY_STEPS)だけをやり直す
+if [ -n "$RETRY_STEPS" ]; then
+    DATABASES=$(for DB in $DATABASES; do
+        case " $RETRY_STEPS " in *" $DB "*) echo $DB ;; esac
+    done)
+    case " $RETRY_STEPS " in
+        *" files "*) ;;
+        *) BACKUP_FILES="" ;;
+    esac
+fi
+
+# 実行ログは最初のデータベースのバックアップと同じ名前で保存し、保持期間の判定もそれに合わせる
+RUN_LOG="/misskey-data/backups/${PRIMARY_DB}_${TIMESTAMP}_${RUN_ID}${BACKUP_LABEL:+_${BACKUP_LABEL}}.sql.log"
+
+trap on_interrupt TERM INT
+
+ping_healthcheck /start
+
+check_config_drift
+
+# 中断された実行などでステージング領域・検証用の領域に残ったファイルを削除し、ディスクを使い切らないようにする
+# (rcloneはダウンロード時に元の更新時刻を保つため、更新時刻ではなくこのホストで作成された時刻(ctime)で判定する)
+find /misskey-data/backups /misskey-data/verify -type f -cmin +${STAGING_MAX_AGE:-1440} \
+    -print -exec rm -f {} \; >> $RUN_LOG 2> /dev/null
+
+# アップロード設定 (保存先ごとの設定はstorage.shを参照)
+# 大きなファイルの進捗が分かるよう、UPLOAD_PROGRESS_INTERVALごとに転送量と割合を実行ログに記録する
+UPLOAD_FLAGS="$STORAGE_UPLOAD_FLAGS --multi-thread-cutoff 5000M
+    --stats ${UPLOAD_PROGRESS_INTERVAL:-1m} --stats-one-line --stats-log-level NOTICE"
+
+# 圧縮設定
+# 7zの既定(マルチスレッドのLZMA2)はスレッド数と辞書サイズに応じてメモリを使うため、
+# メモリの少ないサーバーではCOMPRESSION_THREADS・COMPRESSION_DICTIONARYで上限を下げる
+ARCHIVE_FLAGS="${COMPRESSION_THREADS:+-mmt=${COMPRESSION_THREADS}} ${COMPRESSION_DICTIONARY:+-md=${COMPRESSION_DICTIONARY}}"
+
+# 中断された実行で放置されたマルチパートアップロードを中止し、未完了のパートに課金され続けないようにする
+# (rcloneはアップロードの再開に対応していないため、中断されたファイルは次回の実行で最初からアップロードし直す)
+if [ "${STORAGE_BACKEND:-s3}" = "s3" ]; then
+    rclone backend cleanup backup:${R2_PREFIX%%/*} -o max-age=$(( ${MULTIPART_MAX_AGE_DAYS:-1} * 24 ))h >> $RUN_LOG 2>&1
+fi
+
+# Postgresに接続できない場合はダンプを試みず、すべてのデータベースを失敗として通知する
+if ! wait_for_postgres; then
+    POSTGRES_UNREACHABLE=true
+    for DB in $DATABASES; do
+        FAILED="${FAILED:+${FAILED}, }${DB}"
+        FAILED_STEPS="${FAILED_STEPS} ${DB}"
+    done
+    DATABASES=""
+fi
+
+# ダンプ用セッションの設定
+# 長時間のダンプが打ち切られないようstatement_timeoutを無効にし、ロック待ちには上限を設ける
+export PGAPPNAME=misskey-backup
+export PGOPTIONS="-c statement_timeout=0"
+
+# ダンプ形式 (plain / custom / directory)
+# directory形式ではPG_DUMP_JOBSの並列数でダンプする
+case "${PG_DUMP_FORMAT:-plain}" in
+    custom) DUMP_FLAGS="-Fc" ;;
+    directory) DUMP_FLAGS="-Fd -j ${PG_DUMP_JOBS:-1}" ;;
+    *) DUMP_FLAGS="-Fp" ;;
+esac
+
+# BACKUP_DEADLINE (HH:MM、BACKUP_TZの時刻) までに終わらない処理は打ち切り、朝のピーク帯に負荷をかけない
+# 開始時刻より前の時刻を指定した場合は翌日のその時刻とみなす
+if [ -n "$BACKUP_DEADLINE" ]; then
+    DEADLINE=$(TZ="${BACKUP_TZ:-UTC}" date -d "$BACKUP_DEADLINE" +%s)
+    if [ $DEADLINE -le $START_TIME ]; then
+        DEADLINE=$(( DEADLINE + 86400 ))
+    fi
+fi
+
+# データベースごとにダンプ・圧縮・アップロードを行う
+STATUS=0
+[ -z "$POSTGRES_UNREACHABLE" ] || STATUS=1
+TOTAL_SIZE=0
+for DB in $DATABASES; do
+    BACKUP_FILE="/misskey-data/backups/${DB}_${TIMESTAMP}_${RUN_ID}${BACKUP_LABEL:+_${BACKUP_LABEL}}.sql"
+    COMPRESSED="${BACKUP_FILE}.7z${ENCRYPTION_MODE:+.${ENCRYPTION_MODE}}"
+    # pg_dumpのエラー出力は失敗時の通知に含めるため別に保存する
+    DUMP_ERROR="${BACKUP_FILE}.err"
+
+    # ダンプ前後のWAL位置を記録し、Postgresのリカバリ座標と対応付けられるようにする
+    WAL_START_LSN=$(pg_query "SELECT pg_current_wal_lsn()")
+    WAL_TIMELINE=$(pg_query "SELECT timeline_id FROM pg_control_checkpoint()")
+
+    if check_disk_space; then
+        within_window pg_dump -h $POSTGRES_HOST -U $POSTGRES_USER -d $DB \
+            --lock-wait-timeout=${PG_LOCK_WAIT_TIMEOUT:-10min} $DUMP_FLAGS $PG_DUMP_ARGS -f $BACKUP_FILE 2> $DUMP_ERROR
+        DUMP_STATUS=$?
+    else
+        # 途中で容量不足になる前に、このデータベースのダンプを取りやめる
+        echo "$(msg log_disk_space_insufficient "$REQUIRED" "$AVAILABLE")" > $DUMP_ERROR
+        DUMP_STATUS=1
+    fi
+    cat $DUMP_ERROR >> $RUN_LOG
+    WAL_END_LSN=$(pg_query "SELECT pg_current_wal_lsn()")
+    # ロック待ちで打ち切られた場合は原因をログに残す
+    if [ $DUMP_STATUS -ne 0 ] && grep -q "could not obtain lock" $DUMP_ERROR; then
+        log "$(msg log_dump_lock_timeout "${PG_LOCK_WAIT_TIMEOUT:-10min}")"
+    fi
+
+    [ $DUMP_STATUS -eq 0 ] \
+        && within_window 7z a $ARCHIVE_FLAGS ${SPLIT_SIZE:+-v${SPLIT_SIZE}} ${COMPRESSED%.age} $BACKUP_FILE >> $RUN_LOG 2>&1 \
+        && encrypt_archive ${COMPRESSED%.age} \
+        && upload_artifacts $COMPRESSED \
+        && upload_parity $COMPRESSED \
+        && { [ -z "$PRE_UPGRADE" ] || verify_remote_archive $COMPRESSED; } \
+        && write_latest
+
+    # 成功確認
+    if [ $? -eq 0 ]; then
+        log "$(msg log_backup_succeeded "$DB")"
+        SUCCEEDED="${SUCCEEDED:+${SUCCEEDED}
+}${COMPRESSED}"
+        TOTAL_SIZE=$(( TOTAL_SIZE + $(artifacts_size $COMPRESSED) ))
+        SUCCEEDED_DBS="${SUCCEEDED_DBS} ${DB}"
+    else
+        STATUS=1
+        log "$(msg log_backup_failed "$DB")"
+        FAILED="${FAILED:+${FAILED}, }${DB}"
+        FAILED_STEPS="${FAILED_STEPS} ${DB}"
+        if [ -n "$DEADLINE" ] && [ $(date +%s) -ge $DEADLINE ]; then
+            WINDOW_EXCEEDED=true
+            log "$(msg log_window_exceeded "$BACKUP_DEADLINE")"
+        fi
+        quarantine_upload $COMPRESSED
+        if [ $DUMP_STATUS -ne 0 ]; then
+            DUMP_ERRORS="${DUMP_ERRORS}[${DB}] $(tail -n 5 $DUMP_ERROR)
+"
+        fi
+    fi
+
+    # バックアップファイルを削除
+    rm -rf $BACKUP_FILE $DUMP_ERROR
+    rm -rf ${COMPRESSED%.age} $(artifacts $COMPRESSED) ${COMPRESSED}*.par2
+done
+
+# Misskeyのドライブファイル(ローカル保存時)のバックアップ
+# データベースと同じ実行結果として扱い、メトリクス・通知・監視にまとめて反映する
+if [ -n "$BACKUP_FILES" ]; then
+    # 中断された場合の通知に対象として表示する
+    DB=files
+    if [ "${FILES_BACKUP_MODE:-archive}" = "sync" ]; then
+        FILES_DEST="files/current"
+        sync_files
+    else
+        FILES_ARCHIVE="/misskey-data/backups/files_${TIMESTAMP}_${RUN_ID}${BACKUP_LABEL:+_${BACKUP_LABEL}}.tar.7z${ENCRYPTION_MODE:+.${ENCRYPTION_MODE}}"
+        FILES_DEST=$FILES_ARCHIVE
+        # 停止時にtarと7zの両方を止められるよう、パイプラインではなく名前付きパイプでつなぐ
+        mkfifo ${FILES_ARCHIVE}.fifo
+        tar -C $FILES_DIR -cf - . > ${FILES_ARCHIVE}.fifo 2>> $RUN_LOG &
+        FILES_TAR=$!
+        within_window 7z a -si $ARCHIVE_FLAGS ${SPLIT_SIZE:+-v${SPLIT_SIZE}} ${FILES_ARCHIVE%.age} < ${FILES_ARCHIVE}.fifo >> $RUN_LOG 2>&1
+        ARCHIVE_STATUS=$?
+        # tarが途中で失敗しても7zは受け取った分だけでアーカイブを作るため、tarの終了コードも確認する
+        wait $FILES_TAR
+        TAR_STATUS=$?
+        FILES_TAR=""
+        [ $ARCHIVE_STATUS -eq 0 ] && [ $TAR_STATUS -eq 0 ] \
+            && encrypt_archive ${FILES_ARCHIVE%.age} \
+            && upload_artifacts $FILES_ARCHIVE \
+            && upload_parity $FILES_ARCHIVE
+    fi
+
+    if [ $? -eq 0 ]; then
+        log "$(msg log_files_succeeded)"
+    else
+        STATUS=1
+        log "$(msg log_files_failed)"
+        FAILED="${FAILED:+${FAILED}, }files"
+        FAILED_STEPS="${FAILED_STEPS} files"
+        FILES_NOTICE="
+$(msg notify_files_failed)"
+        if [ -n "$FILES_ARCHIVE" ]; then
+            quarantine_upload $FILES_ARCHIVE
+        fi
+    fi
+    if [ -n "$FILES_ARCHIVE" ]; then
+        rm -rf ${FILES_ARCHIVE%.age} $(artifacts $FILES_ARCHIVE) ${FILES_ARCHIVE}*.par2 ${FILES_ARCHIVE}.fifo
+    fi
+fi
+
+# 汎用Webhookの通知に含めるバックアップの情報
+# WEBHOOK_LINK_EXPIRYが設定されている場合は、期限付きのダウンロードURLも含める
+NOTIFY_FILE=$(echo "$RESULT_PARTS" | jq -rs 'add // [] | map(.name) | join(", ")')
+NOTIFY_SIZE=$TOTAL_SIZE
+if [ -n "$WEBHOOK_LINK_EXPIRY" ] && [ -n "$NOTIFY_FILE" ]; then
+    NOTIFY_LINK=$(rclone link --expire $WEBHOOK_LINK_EXPIRY backup:${R2_PREFIX}/${NOTIFY_FILE%%, *} 2>> $RUN_LOG)
+fi
+
+if [ $STATUS -eq 0 ]; then
+    if [ -n "$NOTIFICATION" ] && should_notify_success; then
+        NOTIFY_THIS_SUCCESS=true
+    fi
+    rm -f ${STATE_DIR}/consecutive_failures ${STATE_DIR}/failure_issue_opened
+    write_metrics success
+    cleanup_old_backups
+    cleanup_quarantine
+    tier_old_backups
+    check_storage_usage
+    # 成功通知
+    if [ -n "$NOTIFY_THIS_SUCCESS" ]; then
+        notify success "$(msg notify_backup_succeeded "$SUCCEEDED")${STORAGE_NOTICE:+
+${STORAGE_NOTICE}}"
+        if [ -n "$BACKUP_FILES" ]; then
+            notify info "$(msg notify_files_succeeded "$FILES_DEST")"
+        fi
     fi
 else
     # 失敗時
-    echo "Backup failed" >> /var/log/cron.log
+    write_metrics failure
+    record_failure
+    # 再試行する場合は、再試行しても失敗したときにIssueを作成する
+    NEXT_RETRY=$(next_retry_delay)
+    if [ -z "$NEXT_RETRY" ]; then
+        open_failure_issue
+    fi
     # 通知設定の有無を確認
+    if [ -n "$NEXT_RETRY" ]; then
+        RETRY_NOTICE="
+$(msg notify_retry_scheduled "$NEXT_RETRY")"
+    fi
     if [ -n "$NOTIFICATION" ]; then
-        curl -X POST -F content="❌バックアップに失敗しました。ログを確認してください。" ${DISCORD_WEBHOOK_URL} &> /dev/null
+        if [ -n "$POSTGRES_UNREACHABLE" ]; then
+            notify failure "$(msg notify_backup_failed "$FAILED")
+$(msg log_postgres_unreachable "$POSTGRES_HOST")${FILES_NOTICE}${RETRY_NOTICE}"
+        elif [ -n "$WINDOW_EXCEEDED" ]; then
+            notify failure "$(msg notify_backup_failed "$FAILED")
+$(msg notify_window_exceeded "$BACKUP_DEADLINE")${FILES_NOTICE}${RETRY_NOTICE}"
+        elif [ -n "$DUMP_ERRORS" ]; then
+            notify failure "$(msg notify_backup_failed "$FAILED")
+$(msg notify_dump_failed "$DUMP_ERRORS")${FILES_NOTICE}${RETRY_NOTICE}"
+        else
+            notify failure "$(msg notify_backup_failed "$FAILED")${FILES_NOTICE}${RETRY_NOTICE}"
+        fi
+    fi
+fi
+
+# 実行ログを圧縮してバックアップと同じ場所へアップロード
+if [ -n "$UPLOAD_RUN_LOG" ]; then
+    if [ -n "$RUN_LOG_PASSWORD" ]; then
+        7z a $ARCHIVE_FLAGS -p"$RUN_LOG_PASSWORD" -mhe=on ${RUN_LOG}.7z $RUN_LOG > /dev/null
+    else
+        7z a $ARCHIVE_FLAGS ${RUN_LOG}.7z $RUN_LOG > /dev/null
     fi
+    rclone copy ${RUN_LOG}.7z backup:${R2_PREFIX}/${OBJECT_DIR}
+    rm -rf ${RUN_LOG}.7z
+fi
+cat $RUN_LOG >> /var/log/cron.log
+write_backup_result
+
+# 実行結果を監視サービスへ送信
+if [ $STATUS -eq 0 ]; then
+    ping_healthcheck
+else
+    ping_healthcheck /fail
 fi
 
-# バックアップファイルを削除
-rm -rf $BACKUP_FILE
-rm -rf $COMPRESSED
+# 失敗した場合はRETRY_DELAYSの待ち時間の後に同じ引数で再試行し、失敗したものだけをやり直す
+# (待っている間もロックを保持し、次のスケジュールの実行と重ならないようにする)
+if [ $STATUS -ne 0 ]; then
+    NEXT_RETRY=${NEXT_RETRY:-$(next_retry_delay)}
+    if [ -n "$NEXT_RETRY" ]; then
+        # 結果は記録・通知済みのため、待っている間に停止された場合は再試行を取りやめるだけにする
+        trap 'kill $CHILD 2> /dev/null; echo "$(msg log_interrupted)" >> /var/log/cron.log; rm -rf $RUN_LOG; exit 143' TERM INT
+        sleep $NEXT_RETRY &
+        CHILD=$!
+        wait $CHILD
+        rm -rf $RUN_LOG
+        export RETRY_ATTEMPT=$(( ${RETRY_ATTEMPT:-0} + 1 ))
+        export RETRY_STEPS="$FAILED_STEPS"
+        exec sh /root/backup.sh $ARGS
+    fi
+fi
+
+# 実行ログを削除
+rm -rf $RUN_LOG
+
+exit $STATUS
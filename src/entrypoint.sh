@@ -0,0 +1,63 @@
+#!/bin/sh
+
+# =============================================
+#  コンテナの起動処理
+#  メトリクスのHTTPサーバー(METRICS_PORTを設定した場合のみ)とcrondを起動します。
+#  --once (またはRUN_ONCE) を指定した場合は、バックアップを1回だけ実行してその終了コードで終了します。
+#  (Kubernetes CronJobやホストのcronなど、外部のスケジューラから実行する場合)
+#  BACKUP_UIDを設定した場合は、バックアップなどのジョブをrootではなくそのユーザーで実行します。
+# =============================================
+
+# データ・ログ・保存先の設定の所有者を実行するユーザーに変え、ジョブをsu-execで実行する
+# (ユーザーがいなければ作成する。コンテナを再起動した場合は既存のものを使う)
+if [ -n "$BACKUP_UID" ]; then
+    BACKUP_GID=${BACKUP_GID:-$BACKUP_UID}
+    BACKUP_USER=$(awk -F ':' -v uid="$BACKUP_UID" '$3 == uid { print $1; exit }' /etc/passwd)
+    if [ -z "$BACKUP_USER" ]; then
+        BACKUP_GROUP=$(awk -F ':' -v gid="$BACKUP_GID" '$3 == gid { print $1; exit }' /etc/group)
+        if [ -z "$BACKUP_GROUP" ]; then
+            BACKUP_GROUP=backup
+            addgroup -g $BACKUP_GID $BACKUP_GROUP
+        fi
+        BACKUP_USER=backup
+        adduser -D -H -h /misskey-data -s /bin/sh -u $BACKUP_UID -G $BACKUP_GROUP $BACKUP_USER
+    fi
+    touch /var/log/cron.log
+    chown -R $BACKUP_UID:$BACKUP_GID /misskey-data /var/log/cron.log /root/.config/rclone
+    RUN_AS="su-exec $BACKUP_USER"
+
+    # crondはcrontabのファイル名のユーザーでジョブを実行するため、rootのcrontabをそのユーザー名で置いた別のディレクトリを使う
+    mkdir -p /var/spool/cron/users
+    cp /var/spool/cron/crontabs/root /var/spool/cron/users/$BACKUP_USER
+    CRONTAB_DIR=/var/spool/cron/users
+fi
+
+if [ "$1" = "--once" ] || [ -n "$RUN_ONCE" ]; then
+    [ "$1" = "--once" ] && shift
+    exec $RUN_AS sh /root/backup.sh "$@"
+fi
+
+# 保持期間に合わせたライフサイクルルールを起動時に適用する (失敗してもバックアップは続ける)
+if [ -n "$LIFECYCLE_RULES" ]; then
+    sh /root/lifecycle.sh
+fi
+
+if [ -n "$METRICS_PORT" ]; then
+    httpd -p $METRICS_PORT -h /misskey-data/metrics -c /etc/httpd.conf
+fi
+
+# crondは停止シグナルをジョブへ伝えないため、コンテナの停止時は実行中のバックアップへ直接送り、
+# 中断の通知と後片付けが終わるまで待ってから終了する
+on_stop() {
+    pkill -TERM -f /root/backup.sh
+    while pgrep -f /root/backup.sh > /dev/null; do
+        sleep 1
+    done
+    kill $CROND 2> /dev/null
+    exit 0
+}
+trap on_stop TERM INT
+
+crond -l 0 -f ${CRONTAB_DIR:+-c $CRONTAB_DIR} &
+CROND=$!
+wait $CROND
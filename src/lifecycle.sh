@@ -0,0 +1,91 @@
+#!/bin/sh
+
+# 通知・ログの文言
+. /root/messages.sh
+# 通知の送信
+. /root/notify.sh
+NOTIFY_EVENT=lifecycle
+
+# =============================================
+#  保持期間の設定に合わせて、R2バケットのライフサイクルルールを作成・更新します。
+#  スクリプトによる削除が何らかの理由で止まった場合に備えた、サーバー側の安全策です。
+#  (保持期間 + LIFECYCLE_MARGIN_DAYS 日を過ぎたバックアップをR2が削除する)
+#  Cloudflare APIを使うため、CLOUDFLARE_ACCOUNT_ID と CLOUDFLARE_API_TOKEN が必要です。
+#  バケットの既存のルールは置き換えられます。
+#  ルールは経過日数だけで判定するため、バックアップが失敗し続けると最後に成功したものも削除されます。
+# =============================================
+
+if [ -z "$CLOUDFLARE_ACCOUNT_ID" ] || [ -z "$CLOUDFLARE_API_TOKEN" ]; then
+    echo "$(msg log_lifecycle_not_configured)" >> /var/log/cron.log
+    exit 1
+fi
+
+BUCKET=${R2_PREFIX%%/*}
+BASE_PATH=""
+case $R2_PREFIX in
+    */*) BASE_PATH="${R2_PREFIX#*/}/" ;;
+esac
+MARGIN_DAYS=${LIFECYCLE_MARGIN_DAYS:-30}
+
+# バックアップ・パリティ・実行ログはすべて <データベース名>_ で始まるため、それを接頭辞にする
+# (pinned/ や drive/、latest.json はどのルールにも一致しない)
+KINDS=$(echo "${POSTGRES_DBS:-$POSTGRES_DB}" | tr ',' ' ')
+[ -n "$FILES_DIR" ] && KINDS="$KINDS files"
+
+# crontabの --schedule <名前> から、スケジュールごとの保持期間を読み取る (backup.shと同じ優先順位)
+SCHEDULES=$(grep -v '^[[:space:]]*#' /var/spool/cron/crontabs/root 2> /dev/null \
+    | sed -n 's/.*--schedule[[:space:]][[:space:]]*\([A-Za-z0-9_-]*\).*/\1/p' | sort -u)
+
+# ルールを1行ずつ「接頭辞;日数」で出力する
+list_rules() {
+    if [ -n "$BACKUP_RETENTION_DAYS" ]; then
+        for KIND in $KINDS; do
+            echo "${BASE_PATH}${KIND}_;${BACKUP_RETENTION_DAYS}"
+        done
+    fi
+    for SCHEDULE in $SCHEDULES; do
+        SCHEDULE_VAR=$(printf %s "$SCHEDULE" | tr 'a-z-' 'A-Z_')
+        eval "DAYS=\${${SCHEDULE_VAR}_RETENTION_DAYS:-\$BACKUP_RETENTION_DAYS}"
+        [ -n "$DAYS" ] || continue
+        for KIND in $KINDS; do
+            echo "${BASE_PATH}${SCHEDULE}/${KIND}_;${DAYS}"
+        done
+    done
+}
+
+RULES=$(list_rules | jq -R -s --argjson margin "$MARGIN_DAYS" '
+    split("\n") | map(select(length > 0) | split(";")) | map({
+        id: ("misskey-backup:" + .[0]),
+        enabled: true,
+        conditions: { prefix: .[0] },
+        deleteObjectsTransition: {
+            condition: { type: "Age", maxAge: (((.[1] | tonumber) + $margin) * 86400) }
+        }
+    }) | { rules: . }')
+
+COUNT=$(echo "$RULES" | jq '.rules | length')
+if [ "$COUNT" -eq 0 ]; then
+    # 件数だけの保持設定はライフサイクルルールで表せないため、何もしない
+    echo "$(msg log_lifecycle_no_rules)" >> /var/log/cron.log
+    exit 0
+fi
+
+RESPONSE=$(echo "$RULES" | curl -s -X PUT \
+    -H "Authorization: Bearer ${CLOUDFLARE_API_TOKEN}" \
+    -H "Content-Type: application/json" \
+    --data-binary @- \
+    "https://api.cloudflare.com/client/v4/accounts/${CLOUDFLARE_ACCOUNT_ID}/r2/buckets/${BUCKET}/lifecycle")
+
+if [ "$(echo "$RESPONSE" | jq -r '.success' 2> /dev/null)" = "true" ]; then
+    STATUS=0
+    echo "$(msg log_lifecycle_applied "$COUNT" "$BUCKET")" >> /var/log/cron.log
+else
+    STATUS=1
+    echo "$(msg log_lifecycle_failed "$BUCKET")" >> /var/log/cron.log
+    echo "$RESPONSE" >> /var/log/cron.log
+    if [ -n "$NOTIFICATION" ]; then
+        notify failure "$(msg notify_lifecycle_failed "$BUCKET")"
+    fi
+fi
+
+exit $STATUS
@@ -0,0 +1,15 @@
+#!/bin/sh
+
+# 保存先の設定
+. /root/storage.sh
+
+# =============================================
+#  保存されているバックアップの一覧を、マニフェストから作成日時の古い順に表示します。
+#  使い方: list.sh [データベース名]
+# =============================================
+
+echo "CREATED_AT	DATABASE	SIZE	LABEL	NAME"
+rclone cat --filter "- failed/**" --filter "+ *.manifest.json" --filter "- *" backup:${R2_PREFIX} \
+    | jq -rs --arg database "$1" \
+        'map(select($database == "" or .database == $database)) | sort_by(.created_at) | .[]
+         | [.created_at, .database, .size, (.label // "-"), .name] | @tsv'
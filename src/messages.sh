@@ -0,0 +1,188 @@
+#!/bin/sh
+
+# =============================================
+#  通知・ログの文言
+#  MESSAGE_LANG (ja / en) に応じた文言を返します。
+#  使い方: msg <キー> [引数...]
+# =============================================
+
+msg() {
+    KEY=$1
+    shift
+    case "${MESSAGE_LANG:-ja}" in
+        en)
+            case "$KEY" in
+                log_backup_succeeded) FORMAT="Backup succeeded: %s" ;;
+                log_backup_failed) FORMAT="Backup failed: %s" ;;
+                notify_backup_succeeded) FORMAT="✅Backup completed.\n%s" ;;
+                notify_backup_failed) FORMAT="❌Backup failed. Please check the logs. (%s)" ;;
+                notify_dump_failed) FORMAT="pg_dump errors:\n\`\`\`\n%s\n\`\`\`" ;;
+                log_files_succeeded) FORMAT="Files backup succeeded" ;;
+                log_files_failed) FORMAT="Files backup failed" ;;
+                notify_files_succeeded) FORMAT="✅Files backup completed. (%s)" ;;
+                notify_files_failed) FORMAT="❌Files backup failed. Please check the logs." ;;
+                log_config_changed) FORMAT="Configuration changed since the last run:\n%s" ;;
+                notify_config_changed) FORMAT="⚠️Backup configuration changed since the last run.\n\`\`\`\n%s\n\`\`\`" ;;
+                log_mirror_not_configured) FORMAT="DRIVE_SOURCE is not set" ;;
+                log_mirror_succeeded) FORMAT="Drive mirroring succeeded" ;;
+                log_mirror_failed) FORMAT="Drive mirroring failed" ;;
+                notify_mirror_succeeded) FORMAT="✅Drive mirroring completed. (%s)" ;;
+                notify_mirror_failed) FORMAT="❌Drive mirroring failed. Please check the logs. (%s)" ;;
+                notify_storage_usage) FORMAT="Storage used: %s" ;;
+                notify_storage_quota) FORMAT="Storage used: %s / %s (%s%%)" ;;
+                notify_quota_exceeded) FORMAT="⚠️Storage usage is above %s%% of the quota." ;;
+                log_tier_failed) FORMAT="Failed to move old backups to storage class %s" ;;
+                log_latest_failed) FORMAT="Failed to upload the manifest and latest pointer: %s" ;;
+                log_quota_exceeded) FORMAT="Storage usage %s bytes exceeds the warning threshold of %s bytes" ;;
+                log_quota_prune_insufficient) FORMAT="Deleting every old backup would free only %s bytes and usage would stay above %s bytes; nothing was deleted" ;;
+                log_quota_pruned) FORMAT="Deleted an old backup to stay under the quota: %s" ;;
+                log_lifecycle_not_configured) FORMAT="CLOUDFLARE_ACCOUNT_ID and CLOUDFLARE_API_TOKEN are required to manage lifecycle rules" ;;
+                log_lifecycle_no_rules) FORMAT="No retention period in days is configured, so no lifecycle rules were applied" ;;
+                log_lifecycle_applied) FORMAT="Applied %s lifecycle rule(s) to bucket %s" ;;
+                log_lifecycle_failed) FORMAT="Failed to apply lifecycle rules to bucket %s" ;;
+                notify_lifecycle_failed) FORMAT="❌Failed to apply lifecycle rules to bucket %s. Please check the logs." ;;
+                notify_summary) FORMAT="📊Backup summary for the last %s days\nRuns: %s (failed: %s)\nBacked up: %s\nAverage duration: %s s\nStorage used: %s" ;;
+                notify_test_success) FORMAT="✅[Test] This is a sample success notification." ;;
+                notify_test_failure) FORMAT="❌[Test] This is a sample failure notification." ;;
+                notify_test_delivered) FORMAT="%s (%s): delivered" ;;
+                notify_test_undelivered) FORMAT="%s (%s): FAILED to deliver" ;;
+                notify_test_no_notifier) FORMAT="No notification destination is configured" ;;
+                issue_title) FORMAT="Backup of %s failed %s times in a row" ;;
+                log_upload_size_mismatch) FORMAT="Uploaded size mismatch: %s (local: %s, remote: %s)" ;;
+                log_checksum_mismatch) FORMAT="Checksum of the uploaded object does not match: %s" ;;
+                config_missing) FORMAT="%s is not set" ;;
+                config_not_integer) FORMAT="%s must be a non-negative integer: %s" ;;
+                config_out_of_range) FORMAT="%s must be in the range %s: %s" ;;
+                config_invalid_choice) FORMAT="%s must be one of (%s): %s" ;;
+                config_invalid_duration) FORMAT="%s must be a duration such as 30s, 10m or 1h: %s" ;;
+                config_invalid_url) FORMAT="%s must be an http(s) URL: %s" ;;
+                config_not_file) FORMAT="%s is not a readable file: %s" ;;
+                config_not_directory) FORMAT="%s is not a directory: %s" ;;
+                config_conflict) FORMAT="%s cannot be used with %s" ;;
+                config_no_notifier) FORMAT="NOTIFICATION is enabled but no notifier is configured" ;;
+                notify_config_invalid) FORMAT="❌The backup was not run because of configuration errors.\n\`\`\`\n%s\n\`\`\`" ;;
+                retry_attempt) FORMAT="retry %s/%s" ;;
+                notify_retry_scheduled) FORMAT="🔁Retrying in %s seconds." ;;
+                log_interrupted) FORMAT="Interrupted by a stop signal" ;;
+                notify_interrupted) FORMAT="⚠️The backup was interrupted because the container is stopping. (%s)" ;;
+                log_window_exceeded) FORMAT="Aborted: the backup window ends at %s" ;;
+                notify_window_exceeded) FORMAT="The backup did not finish within the backup window (until %s) and was aborted." ;;
+                log_backup_skipped_locked) FORMAT="Skipped: the previous backup run is still in progress" ;;
+                notify_backup_skipped_locked) FORMAT="⚠️Skipped this backup because the previous run is still in progress." ;;
+                log_backup_skipped_queue) FORMAT="Skipped: another backup run did not finish within %s seconds" ;;
+                notify_backup_skipped_queue) FORMAT="⚠️Skipped this backup because another backup run did not finish within %s seconds." ;;
+                log_postgres_unreachable) FORMAT="Gave up waiting for Postgres to accept connections: %s" ;;
+                log_disk_space_insufficient) FORMAT="Not enough free space in the staging area: %s bytes required, %s bytes available" ;;
+                log_dump_lock_timeout) FORMAT="pg_dump gave up waiting for table locks (lock wait timeout: %s)" ;;
+                log_retention_deleted) FORMAT="Deleted backup past retention: %s" ;;
+                log_quarantined) FORMAT="Moved incomplete object to failed/: %s" ;;
+                log_verify_no_backup) FORMAT="No backup to verify" ;;
+                log_verify_succeeded) FORMAT="Verification succeeded: %s" ;;
+                log_verify_failed) FORMAT="Verification failed: %s" ;;
+                log_restore_identity_missing) FORMAT="This backup is encrypted with age; pass the private key with --identity or AGE_IDENTITY" ;;
+                log_verify_encrypted) FORMAT="No AGE_IDENTITY is set, so only the checksums of the encrypted backup were verified: %s" ;;
+                log_restore_succeeded) FORMAT="Backup downloaded and extracted to %s" ;;
+                log_restore_applied) FORMAT="Restored the dump into database %s" ;;
+                log_restore_production_refused) FORMAT="%s is a production database; pass --yes-i-mean-it %s to overwrite it" ;;
+                log_restore_apply_failed) FORMAT="Failed to restore the dump into database %s" ;;
+                log_restore_failed) FORMAT="Failed to download or extract the backup: %s" ;;
+                log_verify_dump_incomplete) FORMAT="The dump is incomplete: %s" ;;
+                notify_verify_succeeded) FORMAT="🔍Backup verification passed. (%s)" ;;
+                notify_verify_failed) FORMAT="❌Backup verification failed. The stored backup may be corrupted. (%s)" ;;
+                issue_body) FORMAT="The backup has failed %s consecutive times.\n\n\`\`\`\n%s\n\`\`\`" ;;
+            esac
+            ;;
+        *)
+            case "$KEY" in
+                log_backup_succeeded) FORMAT="バックアップが完了しました: %s" ;;
+                log_backup_failed) FORMAT="バックアップに失敗しました: %s" ;;
+                notify_backup_succeeded) FORMAT="✅バックアップが完了しました。\n%s" ;;
+                notify_backup_failed) FORMAT="❌バックアップに失敗しました。ログを確認してください。(%s)" ;;
+                notify_dump_failed) FORMAT="pg_dumpのエラー:\n\`\`\`\n%s\n\`\`\`" ;;
+                log_files_succeeded) FORMAT="ファイルのバックアップが完了しました" ;;
+                log_files_failed) FORMAT="ファイルのバックアップに失敗しました" ;;
+                notify_files_succeeded) FORMAT="✅ファイルのバックアップが完了しました。(%s)" ;;
+                notify_files_failed) FORMAT="❌ファイルのバックアップに失敗しました。ログを確認してください。" ;;
+                log_config_changed) FORMAT="前回の実行から設定が変更されました:\n%s" ;;
+                notify_config_changed) FORMAT="⚠️前回の実行からバックアップの設定が変更されました。\n\`\`\`\n%s\n\`\`\`" ;;
+                log_mirror_not_configured) FORMAT="DRIVE_SOURCEが設定されていません" ;;
+                log_mirror_succeeded) FORMAT="ドライブのミラーリングが完了しました" ;;
+                log_mirror_failed) FORMAT="ドライブのミラーリングに失敗しました" ;;
+                notify_mirror_succeeded) FORMAT="✅ドライブのミラーリングが完了しました。(%s)" ;;
+                notify_mirror_failed) FORMAT="❌ドライブのミラーリングに失敗しました。ログを確認してください。(%s)" ;;
+                notify_storage_usage) FORMAT="保存先の使用量: %s" ;;
+                notify_storage_quota) FORMAT="保存先の使用量: %s / %s (%s%%)" ;;
+                notify_quota_exceeded) FORMAT="⚠️保存先の使用量が容量上限の%s%%を超えています。" ;;
+                log_tier_failed) FORMAT="古いバックアップのストレージクラス %s への移動に失敗しました" ;;
+                log_latest_failed) FORMAT="マニフェストと最新のバックアップへのポインタをアップロードできませんでした: %s" ;;
+                log_quota_exceeded) FORMAT="保存先の使用量(%sバイト)が警告の基準(%sバイト)を超えています" ;;
+                log_quota_prune_insufficient) FORMAT="古いバックアップをすべて削除しても%sバイトしか減らず、基準(%sバイト)を下回らないため、削除しませんでした" ;;
+                log_quota_pruned) FORMAT="容量上限を超えないよう古いバックアップを削除しました: %s" ;;
+                log_lifecycle_not_configured) FORMAT="ライフサイクルルールの管理にはCLOUDFLARE_ACCOUNT_IDとCLOUDFLARE_API_TOKENが必要です" ;;
+                log_lifecycle_no_rules) FORMAT="日数による保持期間が設定されていないため、ライフサイクルルールは適用しませんでした" ;;
+                log_lifecycle_applied) FORMAT="%s件のライフサイクルルールをバケット %s に適用しました" ;;
+                log_lifecycle_failed) FORMAT="バケット %s へのライフサイクルルールの適用に失敗しました" ;;
+                notify_lifecycle_failed) FORMAT="❌バケット %s へのライフサイクルルールの適用に失敗しました。ログを確認してください。" ;;
+                notify_summary) FORMAT="📊直近%s日間のバックアップ\n実行回数: %s (失敗: %s)\nバックアップ量: %s\n平均所要時間: %s秒\n保存先の使用量: %s" ;;
+                notify_test_success) FORMAT="✅【テスト】成功通知のサンプルです。" ;;
+                notify_test_failure) FORMAT="❌【テスト】失敗通知のサンプルです。" ;;
+                notify_test_delivered) FORMAT="%s (%s): 送信しました" ;;
+                notify_test_undelivered) FORMAT="%s (%s): 送信に失敗しました" ;;
+                notify_test_no_notifier) FORMAT="通知先が設定されていません" ;;
+                issue_title) FORMAT="%sのバックアップが%s回連続で失敗しています" ;;
+                log_upload_size_mismatch) FORMAT="アップロード後のサイズが一致しません: %s (ローカル: %s, リモート: %s)" ;;
+                log_checksum_mismatch) FORMAT="アップロードしたオブジェクトのハッシュ値が一致しません: %s" ;;
+                config_missing) FORMAT="%sが設定されていません" ;;
+                config_not_integer) FORMAT="%sには0以上の整数を指定してください: %s" ;;
+                config_out_of_range) FORMAT="%sには%sの範囲で指定してください: %s" ;;
+                config_invalid_choice) FORMAT="%sには(%s)のいずれかを指定してください: %s" ;;
+                config_invalid_duration) FORMAT="%sには30s・10m・1hのような時間を指定してください: %s" ;;
+                config_invalid_url) FORMAT="%sにはhttp(s)のURLを指定してください: %s" ;;
+                config_not_file) FORMAT="%sが読み取れるファイルではありません: %s" ;;
+                config_not_directory) FORMAT="%sがディレクトリではありません: %s" ;;
+                config_conflict) FORMAT="%sは%sと併用できません" ;;
+                config_no_notifier) FORMAT="NOTIFICATIONが有効ですが、通知先が設定されていません" ;;
+                notify_config_invalid) FORMAT="❌設定に誤りがあるため、バックアップを実行しませんでした。\n\`\`\`\n%s\n\`\`\`" ;;
+                retry_attempt) FORMAT="再試行 %s/%s" ;;
+                notify_retry_scheduled) FORMAT="🔁%s秒後に再試行します。" ;;
+                log_interrupted) FORMAT="停止シグナルを受けたため中断しました" ;;
+                notify_interrupted) FORMAT="⚠️コンテナの停止によりバックアップを中断しました。(%s)" ;;
+                log_window_exceeded) FORMAT="バックアップの終了期限(%s)を過ぎたため中断しました" ;;
+                notify_window_exceeded) FORMAT="バックアップの終了期限(%s)までに完了しなかったため中断しました。" ;;
+                log_backup_skipped_locked) FORMAT="前回のバックアップが実行中のため、今回の実行を見送りました" ;;
+                notify_backup_skipped_locked) FORMAT="⚠️前回のバックアップが実行中のため、今回のバックアップを見送りました。" ;;
+                log_backup_skipped_queue) FORMAT="別のバックアップが%s秒以内に終わらなかったため、今回の実行を見送りました" ;;
+                notify_backup_skipped_queue) FORMAT="⚠️別のバックアップが%s秒以内に終わらなかったため、今回のバックアップを見送りました。" ;;
+                log_postgres_unreachable) FORMAT="Postgresへの接続を待ちましたが、応答がありませんでした: %s" ;;
+                log_disk_space_insufficient) FORMAT="ステージング領域の空き容量が不足しています: 必要 %s バイト / 空き %s バイト" ;;
+                log_dump_lock_timeout) FORMAT="テーブルのロック待ちが上限を超えたためpg_dumpを中断しました (ロック待ち上限: %s)" ;;
+                log_retention_deleted) FORMAT="保持期間を過ぎたバックアップを削除しました: %s" ;;
+                log_quarantined) FORMAT="不完全なオブジェクトをfailed/へ移動しました: %s" ;;
+                log_verify_no_backup) FORMAT="検証対象のバックアップがありません" ;;
+                log_verify_succeeded) FORMAT="検証に成功しました: %s" ;;
+                log_verify_failed) FORMAT="検証に失敗しました: %s" ;;
+                log_restore_identity_missing) FORMAT="ageで暗号化されたバックアップです。--identity またはAGE_IDENTITYで秘密鍵を指定してください" ;;
+                log_verify_encrypted) FORMAT="AGE_IDENTITYが設定されていないため、暗号化されたバックアップはハッシュ値のみ照合しました: %s" ;;
+                log_restore_succeeded) FORMAT="バックアップをダウンロードし、%s に展開しました" ;;
+                log_restore_applied) FORMAT="ダンプをデータベース %s に読み込みました" ;;
+                log_restore_production_refused) FORMAT="%s は稼働中のデータベースです。上書きする場合は --yes-i-mean-it %s を指定してください" ;;
+                log_restore_apply_failed) FORMAT="ダンプのデータベース %s への読み込みに失敗しました" ;;
+                log_restore_failed) FORMAT="バックアップのダウンロードまたは展開に失敗しました: %s" ;;
+                log_verify_dump_incomplete) FORMAT="ダンプが最後まで書き出されていません: %s" ;;
+                notify_verify_succeeded) FORMAT="🔍バックアップの検証に成功しました。(%s)" ;;
+                notify_verify_failed) FORMAT="❌バックアップの検証に失敗しました。保存済みのバックアップが破損している可能性があります。(%s)" ;;
+                issue_body) FORMAT="バックアップが%s回連続で失敗しました。\n\n\`\`\`\n%s\n\`\`\`" ;;
+            esac
+            ;;
+    esac
+    printf "$FORMAT" "$@"
+}
+
+# バイト数を読みやすい単位(KiB, MiB, ...)に変換する
+human_size() {
+    awk -v bytes="$1" 'BEGIN {
+        split("B KiB MiB GiB TiB", unit, " "); i = 1
+        while (bytes >= 1024 && i < 5) { bytes /= 1024; i++ }
+        printf(i == 1 ? "%d %s" : "%.1f %s", bytes, unit[i])
+    }'
+}
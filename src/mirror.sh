@@ -0,0 +1,40 @@
+#!/bin/sh
+
+# 通知・ログの文言
+. /root/messages.sh
+# 通知の送信
+. /root/notify.sh
+# 保存先の設定
+. /root/storage.sh
+NOTIFY_EVENT=mirror
+
+# =============================================
+#  Misskeyのドライブがオブジェクトストレージにある場合に、
+#  そのバケットをバックアップ先の drive/ 以下へミラーリングします。
+#  接続情報は RCLONE_CONFIG_DRIVE_* で設定します。
+# =============================================
+
+if [ -z "$DRIVE_SOURCE" ]; then
+    echo "$(msg log_mirror_not_configured)" >> /var/log/cron.log
+    exit 1
+fi
+
+# 同じプロバイダ・アカウント間ではサーバーサイドコピーを使い、バックアップホストの帯域を使わない
+rclone sync --server-side-across-configs --fast-list \
+    drive:${DRIVE_SOURCE} backup:${R2_PREFIX}/drive >> /var/log/cron.log 2>&1
+
+if [ $? -eq 0 ]; then
+    STATUS=0
+    echo "$(msg log_mirror_succeeded)" >> /var/log/cron.log
+    if [ -n "$NOTIFICATION" ]; then
+        notify info "$(msg notify_mirror_succeeded "$DRIVE_SOURCE")"
+    fi
+else
+    STATUS=1
+    echo "$(msg log_mirror_failed)" >> /var/log/cron.log
+    if [ -n "$NOTIFICATION" ]; then
+        notify failure "$(msg notify_mirror_failed "$DRIVE_SOURCE")"
+    fi
+fi
+
+exit $STATUS
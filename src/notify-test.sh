@@ -0,0 +1,34 @@
+#!/bin/sh
+
+# 通知・ログの文言
+. /root/messages.sh
+# 通知の送信
+. /root/notify.sh
+NOTIFY_EVENT=test
+
+# =============================================
+#  設定されているすべての通知先へ成功・失敗のサンプル通知を送信し、
+#  送信結果を表示します。
+# =============================================
+
+NOTIFIERS=$(notifiers)
+if [ -z "$NOTIFIERS" ]; then
+    msg notify_test_no_notifier
+    echo
+    exit 1
+fi
+
+STATUS=0
+for NOTIFIER in $NOTIFIERS; do
+    for TYPE in success failure; do
+        if send_notification $NOTIFIER $TYPE "$(msg notify_test_$TYPE)"; then
+            msg notify_test_delivered $NOTIFIER $TYPE
+        else
+            STATUS=1
+            msg notify_test_undelivered $NOTIFIER $TYPE
+        fi
+        echo
+    done
+done
+
+exit $STATUS
@@ -0,0 +1,148 @@
+#!/bin/sh
+
+# =============================================
+#  通知の送信
+#  設定されている通知先へメッセージを送信します。
+#  使い方: notify <success|failure|info> <メッセージ>
+#  汎用Webhookには、呼び出し側が設定したNOTIFY_EVENT・NOTIFY_FILE・NOTIFY_SIZE・NOTIFY_LINK・START_TIMEも含める
+# =============================================
+
+# 設定されている通知先の一覧を出力する
+notifiers() {
+    if [ -n "$DISCORD_WEBHOOK_URL" ]; then
+        echo discord
+    fi
+    if [ -n "$TELEGRAM_BOT_TOKEN" ] && [ -n "$TELEGRAM_CHAT_ID" ]; then
+        echo telegram
+    fi
+    if [ -n "$NTFY_URL" ]; then
+        echo ntfy
+    fi
+    if [ -n "$GOTIFY_URL" ] && [ -n "$GOTIFY_TOKEN" ]; then
+        echo gotify
+    fi
+    if [ -n "$WEBHOOK_URL" ]; then
+        echo webhook
+    fi
+}
+
+# Discordへ投稿する
+send_discord() {
+    curl -sf -X POST -F content="$1" ${DISCORD_WEBHOOK_URL} > /dev/null 2>&1
+}
+
+# Discordへ投稿した前回の成功メッセージを編集する
+# 編集できなかった場合(削除済みなど)は新規に投稿し、そのIDを保存する
+edit_discord() {
+    MESSAGE_ID_FILE="/misskey-data/state/discord_message_id"
+    PAYLOAD=$(jq -n --arg content "$1" '{content: $content}')
+
+    if [ -s "$MESSAGE_ID_FILE" ] && curl -sf -X PATCH -H "Content-Type: application/json" -d "$PAYLOAD" \
+        "${DISCORD_WEBHOOK_URL}/messages/$(cat $MESSAGE_ID_FILE)" > /dev/null 2>&1; then
+        return
+    fi
+    MESSAGE_ID=$(curl -sf -X POST -H "Content-Type: application/json" -d "$PAYLOAD" "${DISCORD_WEBHOOK_URL}?wait=true" \
+        | jq -r '.id // empty')
+    [ -n "$MESSAGE_ID" ] || return 1
+    echo $MESSAGE_ID > $MESSAGE_ID_FILE
+}
+
+# Telegramのボットからチャットへ投稿する
+send_telegram() {
+    curl -sf -X POST --data-urlencode chat_id="$TELEGRAM_CHAT_ID" --data-urlencode text="$1" \
+        "https://api.telegram.org/bot${TELEGRAM_BOT_TOKEN}/sendMessage" > /dev/null 2>&1
+}
+
+# ntfyのトピック(NTFY_URL)へ送信する。失敗通知は優先度を上げてスマートフォンで目立つようにする
+# send_ntfy <success|failure|info> <メッセージ>
+send_ntfy() {
+    case "$1" in
+        failure) PRIORITY=high ;;
+        *) PRIORITY=default ;;
+    esac
+    curl -sf -X POST -H "Title: misskey-backup" -H "Priority: $PRIORITY" \
+        ${NTFY_TOKEN:+-H "Authorization: Bearer $NTFY_TOKEN"} \
+        --data-binary "$2" "$NTFY_URL" > /dev/null 2>&1
+}
+
+# Gotifyのアプリケーショントークン(GOTIFY_TOKEN)でメッセージを送信する
+# send_gotify <success|failure|info> <メッセージ>
+send_gotify() {
+    case "$1" in
+        failure) PRIORITY=8 ;;
+        *) PRIORITY=4 ;;
+    esac
+    curl -sf -X POST -H "X-Gotify-Key: $GOTIFY_TOKEN" \
+        -F title=misskey-backup -F message="$2" -F priority=$PRIORITY \
+        "${GOTIFY_URL%/}/message" > /dev/null 2>&1
+}
+
+# WEBHOOK_URLへ機械可読なJSONを送信する
+# WEBHOOK_SECRETが設定されている場合は、本文のHMAC-SHA256をX-Signature-256ヘッダーに付ける
+# send_webhook <success|failure|info> <メッセージ>
+send_webhook() {
+    PAYLOAD=$(jq -cn \
+        --arg event "${NOTIFY_EVENT:-backup}" \
+        --arg status "$1" \
+        --arg message "$2" \
+        --arg file "$NOTIFY_FILE" \
+        --arg size "$NOTIFY_SIZE" \
+        --arg duration "$([ -n "$START_TIME" ] && echo $(( $(date +%s) - START_TIME )))" \
+        --arg link "$NOTIFY_LINK" \
+        '{event: $event, status: $status, message: $message,
+          file: (if $file == "" then null else $file end),
+          size: ($size | tonumber? // null),
+          duration: ($duration | tonumber? // null),
+          url: (if $link == "" then null else $link end),
+          error: (if $status == "failure" then $message else null end)}')
+    if [ -n "$WEBHOOK_SECRET" ]; then
+        SIGNATURE=$(printf %s "$PAYLOAD" | openssl dgst -sha256 -hmac "$WEBHOOK_SECRET" | sed 's/^.* //')
+    fi
+    curl -sf -X POST -H "Content-Type: application/json" \
+        ${SIGNATURE:+-H "X-Signature-256: sha256=$SIGNATURE"} \
+        --data-binary "$PAYLOAD" "$WEBHOOK_URL" > /dev/null 2>&1
+}
+
+# 指定した通知先へメッセージを送信する
+# send_notification <通知先> <success|failure|info> <メッセージ>
+send_notification() {
+    case "$1" in
+        discord)
+            # DISCORD_EDIT_MESSAGEが有効な場合、成功通知は前回のメッセージを編集して投稿数を抑える
+            if [ "$2" = "success" ] && [ -n "$DISCORD_EDIT_MESSAGE" ]; then
+                edit_discord "$3"
+            else
+                send_discord "$3"
+            fi
+            ;;
+        telegram)
+            send_telegram "$3"
+            ;;
+        ntfy)
+            send_ntfy "$2" "$3"
+            ;;
+        gotify)
+            send_gotify "$2" "$3"
+            ;;
+        webhook)
+            send_webhook "$2" "$3"
+            ;;
+    esac
+}
+
+# 設定されているすべての通知先へメッセージを送信する
+# NOTIFY_TAGが設定されている場合はメッセージの先頭に [NOTIFY_TAG] を付ける
+# NOTIFY_FALLBACKに通知先をカンマ区切りで指定した場合は、その順に送信を試み、最初に届いた時点で終了する
+notify() {
+    set -- "$1" "${NOTIFY_TAG:+[${NOTIFY_TAG}] }$2"
+    if [ -n "$NOTIFY_FALLBACK" ]; then
+        for NOTIFIER in $(echo "$NOTIFY_FALLBACK" | tr ',' ' '); do
+            notifiers | grep -qx "$NOTIFIER" || continue
+            send_notification $NOTIFIER "$1" "$2" && return 0
+        done
+        return 1
+    fi
+    for NOTIFIER in $(notifiers); do
+        send_notification $NOTIFIER "$1" "$2"
+    done
+}
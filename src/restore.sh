@@ -0,0 +1,173 @@
+#!/bin/sh
+
+# 通知・ログの文言
+. /root/messages.sh
+# 保存先の設定
+. /root/storage.sh
+# 実行結果の書き出し
+. /root/result.sh
+
+# ダンプには機密情報が含まれるため、作成するファイルは所有者のみ読み書きできるようにする
+umask 077
+
+# =============================================
+#  保存先からバックアップをダウンロードし、展開します。
+#  restore.sh          latest.jsonが指す最新のバックアップ (なければ最も新しいもの)
+#  restore.sh <名前>   指定したバックアップ
+#  --identity <鍵ファイル>  ageで暗号化したバックアップを復号する秘密鍵 (AGE_IDENTITYでも指定できる)
+#  --apply            展開したダンプを作業用のデータベース(<元のDB名>_restore)へ読み込む
+#                     (プレーン形式はpsql、custom/directory形式はpg_restoreを使う)
+#  --database <名前>  --applyで読み込むデータベース (RESTORE_DBでも指定できる。なければ作成する)
+#  --clean            --applyの前に読み込み先のデータベースを削除して作り直す
+#  --jobs <数>        custom/directory形式をpg_restoreで並列に読み込む数
+#  --yes-i-mean-it <名前>  稼働中のデータベース (POSTGRES_DB/POSTGRES_DBS、バックアップ元) へ読み込む場合の確認
+#                     (読み込み先と同じデータベース名を入力した場合のみ上書きする)
+#  展開したダンプは /misskey-data/restore に置かれます。
+# =============================================
+
+START_TIME=$(date +%s)
+RESTORE_DIR="/misskey-data/restore"
+mkdir -p $RESTORE_DIR
+
+while [ $# -gt 0 ]; do
+    case "$1" in
+        --identity)
+            AGE_IDENTITY=$2
+            shift
+            ;;
+        --apply)
+            APPLY=true
+            ;;
+        --database)
+            RESTORE_DB=$2
+            shift
+            ;;
+        --clean)
+            CLEAN=true
+            ;;
+        --jobs)
+            JOBS=$2
+            shift
+            ;;
+        --yes-i-mean-it)
+            CONFIRM_DB=$2
+            shift
+            ;;
+        *)
+            TARGET=$1
+            ;;
+    esac
+    shift
+done
+
+if [ -z "$TARGET" ]; then
+    MANIFEST=$(rclone cat backup:${R2_PREFIX}/latest.json 2> /dev/null)
+    TARGET=$(echo "$MANIFEST" | jq -r '.name // empty' 2> /dev/null)
+    if [ -z "$TARGET" ]; then
+        TARGET=$(TZ=UTC rclone lsf --files-only --format tp --separator ';' \
+            --include "*.sql.7z" --include "*.sql.7z.001" --include "*.sql.7z.age" backup:${R2_PREFIX} | sort -r | head -n 1 | cut -d ';' -f 2)
+    fi
+fi
+if [ -z "$TARGET" ]; then
+    msg log_verify_no_backup; echo
+    exit 1
+fi
+if [ -z "$MANIFEST" ]; then
+    MANIFEST=$(rclone cat backup:${R2_PREFIX}/${TARGET%.7z*}.manifest.json 2> /dev/null)
+fi
+
+# ダウンロードし、ハッシュ値を照合してから展開する
+restore_download() {
+    rclone copy --include "${TARGET%.001}*" backup:${R2_PREFIX} $RESTORE_DIR || return 1
+
+    PARITY="$RESTORE_DIR/${TARGET%.001}.par2"
+    if [ -f "$PARITY" ]; then
+        par2 repair -q $PARITY || return 1
+    fi
+
+    if [ -n "$MANIFEST" ]; then
+        for PART in $(echo "$MANIFEST" | jq -r '.parts[] | "\(.name):\(.sha256)"'); do
+            if [ "$(sha256sum $RESTORE_DIR/${PART%:*} | cut -d ' ' -f 1)" != "${PART##*:}" ]; then
+                msg log_checksum_mismatch "${PART%:*}"; echo
+                return 1
+            fi
+        done
+    fi
+
+    ARCHIVE=$RESTORE_DIR/$TARGET
+    case "$TARGET" in
+        *.age)
+            if [ -z "$AGE_IDENTITY" ]; then
+                msg log_restore_identity_missing; echo
+                return 1
+            fi
+            age -d -i "$AGE_IDENTITY" -o ${ARCHIVE%.age} $ARCHIVE || return 1
+            ARCHIVE=${ARCHIVE%.age}
+            ;;
+    esac
+
+    7z x -y -o$RESTORE_DIR $ARCHIVE > /dev/null || return 1
+}
+
+# 展開したダンプを作業用のデータベースへ読み込む
+# 稼働中のデータベースを上書きしないよう、既定では<元のDB名>_restoreへ読み込む
+restore_apply() {
+    DUMP=$RESTORE_DIR/$(basename ${TARGET%.7z*})
+    SOURCE_DB=$(echo "$MANIFEST" | jq -r '.database // empty' 2> /dev/null)
+    SOURCE_DB=${SOURCE_DB:-$(basename $TARGET | sed 's/_[0-9][0-9][0-9][0-9]-[0-9][0-9]-[0-9][0-9].*$//')}
+    RESTORE_DB=${RESTORE_DB:-${SOURCE_DB}_restore}
+
+    # 稼働中のデータベースへの読み込みは、--yes-i-mean-it で同じ名前を入力した場合のみ許可する
+    for PROTECTED_DB in $(echo "${POSTGRES_DBS:-$POSTGRES_DB},$SOURCE_DB" | tr ',' ' '); do
+        if [ "$RESTORE_DB" = "$PROTECTED_DB" ] && [ "$CONFIRM_DB" != "$RESTORE_DB" ]; then
+            msg log_restore_production_refused "$RESTORE_DB" "$RESTORE_DB"; echo
+            return 1
+        fi
+    done
+
+    if [ -n "$CLEAN" ]; then
+        dropdb -h $POSTGRES_HOST -U $POSTGRES_USER --if-exists $RESTORE_DB || return 1
+    fi
+    if [ -z "$(psql -h $POSTGRES_HOST -U $POSTGRES_USER -d postgres -Atc \
+        "SELECT 1 FROM pg_database WHERE datname = '$RESTORE_DB'")" ]; then
+        createdb -h $POSTGRES_HOST -U $POSTGRES_USER $RESTORE_DB || return 1
+    fi
+
+    if [ -d "$DUMP" ] || [ "$(head -c 5 $DUMP)" = "PGDMP" ]; then
+        pg_restore -h $POSTGRES_HOST -U $POSTGRES_USER -d $RESTORE_DB --exit-on-error ${JOBS:+-j $JOBS} $DUMP
+    else
+        psql -h $POSTGRES_HOST -U $POSTGRES_USER -d $RESTORE_DB -v ON_ERROR_STOP=1 -q -f $DUMP > /dev/null
+    fi
+}
+
+if restore_download; then
+    STATUS=0
+    msg log_restore_succeeded "$RESTORE_DIR/$(basename ${TARGET%.7z*})"; echo
+    if [ -n "$APPLY" ]; then
+        if restore_apply; then
+            msg log_restore_applied "$RESTORE_DB"; echo
+        else
+            STATUS=1
+            msg log_restore_apply_failed "$RESTORE_DB"; echo
+        fi
+    fi
+else
+    STATUS=1
+    msg log_restore_failed "$TARGET"; echo
+fi
+
+# 実行結果をRESULT_FILEに書き出す
+write_result restore "$(jq -n \
+    --arg target "$TARGET" \
+    --argjson parts "$(echo "${MANIFEST:-null}" | jq '.parts // []' 2> /dev/null || echo '[]')" \
+    --arg path "$([ $STATUS -eq 0 ] && echo $RESTORE_DIR/$(basename ${TARGET%.7z*}))" \
+    --arg database "$([ $STATUS -eq 0 ] && [ -n "$APPLY" ] && echo $RESTORE_DB)" \
+    '{target: $target, artifacts: $parts,
+      path: (if $path == "" then null else $path end),
+      database: (if $database == "" then null else $database end)}')"
+
+# ダウンロードしたアーカイブを削除し、展開したダンプだけを残す
+rm -rf $RESTORE_DIR/${TARGET%.001}.[0-9][0-9][0-9] $RESTORE_DIR/${TARGET%.001} $RESTORE_DIR/${TARGET%.001}*.par2 \
+    $RESTORE_DIR/${TARGET%.age}
+
+exit $STATUS
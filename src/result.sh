@@ -0,0 +1,21 @@
+#!/bin/sh
+
+# =============================================
+#  実行結果の書き出し
+#  RESULT_FILEが設定されている場合、CIなどから参照できるよう実行結果をJSONで書き出します。
+#  使い方: write_result <コマンド名> <コマンドごとの項目(JSONオブジェクト)>
+#  status・started_at・finished_at・duration_seconds は、呼び出し側のSTATUS・START_TIMEから作る
+# =============================================
+
+write_result() {
+    [ -n "$RESULT_FILE" ] || return 0
+    jq -n \
+        --arg command "$1" \
+        --arg status "$([ $STATUS -eq 0 ] && echo success || echo failure)" \
+        --argjson started_at "$START_TIME" \
+        --argjson finished_at "$(date +%s)" \
+        --argjson fields "$2" \
+        '{command: $command, status: $status, started_at: ($started_at | todate), finished_at: ($finished_at | todate),
+          duration_seconds: ($finished_at - $started_at)} + $fields' > ${RESULT_FILE}.tmp \
+        && mv ${RESULT_FILE}.tmp $RESULT_FILE
+}
@@ -0,0 +1,58 @@
+#!/bin/sh
+
+# =============================================
+#  保存先 (rcloneの backup: リモート) の設定
+#  STORAGE_BACKENDで保存先の種類を選びます (s3 / gcs / webdav / rclone、既定: s3)
+#  S3互換ストレージの接続情報はビルド時にrclone.confへ書き込まれます。
+#  それ以外の保存先は、実行時に環境変数 (RCLONE_CONFIG_BACKUP_*) で設定を上書きします。
+# =============================================
+
+case ${STORAGE_BACKEND:-s3} in
+    gcs)
+        export RCLONE_CONFIG_BACKUP_TYPE="google cloud storage"
+        # サービスアカウントの鍵を指定しない場合は、Workload Identityなど実行環境の認証情報を使う
+        if [ -n "$GCS_SERVICE_ACCOUNT_FILE" ]; then
+            export RCLONE_CONFIG_BACKUP_SERVICE_ACCOUNT_FILE="$GCS_SERVICE_ACCOUNT_FILE"
+        else
+            export RCLONE_CONFIG_BACKUP_ENV_AUTH=true
+        fi
+        # 均一なバケットレベルのアクセス制御を使うバケットでは、オブジェクトごとのACLを設定できない
+        export RCLONE_CONFIG_BACKUP_BUCKET_POLICY_ONLY=true
+        # オブジェクトのメタデータとして保存するヘッダーの接頭辞
+        METADATA_HEADER=X-Goog-Meta-
+        STORAGE_UPLOAD_FLAGS="${STORAGE_CLASS:+--gcs-storage-class $STORAGE_CLASS}"
+        ;;
+    webdav)
+        export RCLONE_CONFIG_BACKUP_TYPE=webdav
+        export RCLONE_CONFIG_BACKUP_URL="$WEBDAV_URL"
+        export RCLONE_CONFIG_BACKUP_VENDOR="${WEBDAV_VENDOR:-nextcloud}"
+        # Bearerトークン、またはBasic認証 (rcloneはパスワードを難読化した形式で受け取る)
+        if [ -n "$WEBDAV_BEARER_TOKEN" ]; then
+            export RCLONE_CONFIG_BACKUP_BEARER_TOKEN="$WEBDAV_BEARER_TOKEN"
+        else
+            export RCLONE_CONFIG_BACKUP_USER="$WEBDAV_USER"
+            export RCLONE_CONFIG_BACKUP_PASS="$(rclone obscure "$WEBDAV_PASSWORD")"
+        fi
+        # WebDAVはオブジェクトのメタデータに対応していないため、ハッシュ値はマニフェストでのみ照合する
+        # (一覧はディレクトリごとにDepth: 1で取得するため、Depth: infinityを禁止したサーバーでも動く)
+        METADATA_HEADER=""
+        # Nextcloudでは大きなファイルをWEBDAV_CHUNK_SIZEごとに分割してアップロードする (0で分割しない)
+        STORAGE_UPLOAD_FLAGS="--webdav-nextcloud-chunk-size=${WEBDAV_CHUNK_SIZE:-10M}"
+        ;;
+    rclone)
+        # 任意のrcloneのリモート (RCLONE_REMOTE、例: dropbox: や sftp:backups) を backup: の別名にする
+        # リモート自体はマウントしたrclone.conf (RCLONE_CONFIG) または RCLONE_CONFIG_<名前>_* で設定する
+        export RCLONE_CONFIG_BACKUP_TYPE=alias
+        export RCLONE_CONFIG_BACKUP_REMOTE="$RCLONE_REMOTE"
+        # 保存先によってメタデータの扱いが異なるため、ハッシュ値はマニフェストでのみ照合する
+        METADATA_HEADER=""
+        STORAGE_UPLOAD_FLAGS=""
+        ;;
+    *)
+        METADATA_HEADER=X-Amz-Meta-
+        # UPLOAD_CUTOFFを超えるファイルはUPLOAD_CHUNK_SIZEごとに分割し、UPLOAD_CONCURRENCY個ずつ並列にアップロードする
+        STORAGE_UPLOAD_FLAGS="--s3-upload-cutoff=${UPLOAD_CUTOFF:-5000M} --s3-chunk-size=${UPLOAD_CHUNK_SIZE:-100M}
+            --s3-upload-concurrency=${UPLOAD_CONCURRENCY:-4}
+            ${STORAGE_CLASS:+--s3-storage-class $STORAGE_CLASS}"
+        ;;
+esac
@@ -0,0 +1,37 @@
+#!/bin/sh
+
+# 通知・ログの文言
+. /root/messages.sh
+# 通知の送信
+. /root/notify.sh
+# 保存先の設定
+. /root/storage.sh
+NOTIFY_EVENT=summary
+
+# =============================================
+#  直近のバックアップの実行結果をまとめて通知します。
+#  使い方: summary.sh [日数 (既定: 7)]
+#  失敗時だけでなく、正常に動いていることを定期的に確認できるようにするためのものです。
+# =============================================
+
+DAYS=${1:-7}
+HISTORY="/misskey-data/state/history"
+
+# 期間内の実行回数・失敗回数・成功したバックアップの合計サイズ・平均所要時間を集計する
+SUMMARY=$(awk -F ';' -v since=$(( $(date +%s) - DAYS * 86400 )) '
+    $1 >= since {
+        runs++; duration += $4
+        if ($2 == "success") size += $3; else failures++
+    }
+    END { printf "%d %d %d %d", runs, failures, size, runs ? duration / runs : 0 }
+' $HISTORY 2> /dev/null)
+set -- ${SUMMARY:-0 0 0 0}
+
+# 保存先の使用量
+USAGE=$(rclone size --json backup:${R2_PREFIX} 2>> /var/log/cron.log | jq -r '.bytes // empty')
+
+MESSAGE=$(msg notify_summary "$DAYS" "$1" "$2" "$(human_size $3)" "$4" "$(human_size ${USAGE:-0})")
+echo "$MESSAGE" >> /var/log/cron.log
+if [ -n "$NOTIFICATION" ]; then
+    notify info "$MESSAGE"
+fi
@@ -0,0 +1,151 @@
+#!/bin/sh
+
+# 通知・ログの文言
+. /root/messages.sh
+# 通知の送信
+. /root/notify.sh
+# 保存先の設定
+. /root/storage.sh
+# 実行結果の書き出し
+. /root/result.sh
+NOTIFY_EVENT=verify
+
+# ダンプや実行ログには機密情報が含まれるため、作成するファイルは所有者のみ読み書きできるようにする
+umask 077
+
+# =============================================
+#  バックアップをダウンロードし、アーカイブの整合性とダンプの完全性を検証します。
+#  verify.sh          保持しているバックアップ(スケジュールごとの<名前>/、pinned/、ファイルのアーカイブを含む)から
+#                     ランダムに1つ選んで検証する
+#  verify.sh latest   latest.jsonが指す最新のバックアップを検証する
+#  verify.sh <名前>   指定したバックアップを検証する
+#  いずれもマニフェストがあれば、記録されたハッシュ値と照合する
+# =============================================
+
+START_TIME=$(date +%s)
+VERIFY_DIR="/misskey-data/verify"
+EXTRACT_DIR="${VERIFY_DIR}/extract"
+mkdir -p $VERIFY_DIR
+
+case "$1" in
+    "")
+        # failed/ の隔離したもの、drive/ のミラー、files/ の差分同期は対象にしない
+        TARGET=$(rclone lsf -R --files-only \
+            --filter "- failed/**" --filter "- drive/**" --filter "- files/**" \
+            --filter "+ *.sql.7z" --filter "+ *.sql.7z.001" --filter "+ *.sql.7z.age" \
+            --filter "+ *.tar.7z" --filter "+ *.tar.7z.001" --filter "+ *.tar.7z.age" \
+            --filter "- *" backup:${R2_PREFIX} | shuf -n 1)
+        ;;
+    latest)
+        MANIFEST=$(rclone cat backup:${R2_PREFIX}/latest.json 2>> /var/log/cron.log)
+        TARGET=$(echo "$MANIFEST" | jq -r '.name // empty')
+        ;;
+    *)
+        TARGET=$1
+        ;;
+esac
+if [ -z "$TARGET" ]; then
+    echo "$(msg log_verify_no_backup)" >> /var/log/cron.log
+    exit 0
+fi
+# latest.jsonを使わない場合は、バックアップと一緒にアップロードしたマニフェストを読み込む
+if [ -z "$MANIFEST" ]; then
+    MANIFEST=$(rclone cat backup:${R2_PREFIX}/${TARGET%.7z*}.manifest.json 2> /dev/null)
+fi
+
+# ダウンロードしたバックアップを検証する
+verify_download() {
+    # 分割されたバックアップは全ボリュームを、パリティがあればそれも合わせてダウンロードする
+    rclone copy --include "/${TARGET%.001}*" backup:${R2_PREFIX} $VERIFY_DIR >> /var/log/cron.log 2>&1 || return 1
+
+    # パリティがあれば、破損している部分を修復する
+    PARITY="$VERIFY_DIR/${TARGET%.001}.par2"
+    if [ -f "$PARITY" ]; then
+        par2 repair -q $PARITY >> /var/log/cron.log 2>&1 || return 1
+    fi
+
+    # オブジェクトのメタデータに記録されたハッシュ値と照合する (転送中の破損を検出する)
+    for PART in $(cd $VERIFY_DIR && ls ${TARGET%.001} ${TARGET%.001}.[0-9][0-9][0-9] 2> /dev/null); do
+        SHA256=$(rclone lsjson --metadata backup:${R2_PREFIX}/$PART 2> /dev/null | jq -r '.[0].Metadata.sha256 // empty')
+        if [ -n "$SHA256" ] && [ "$(sha256sum $VERIFY_DIR/$PART | cut -d ' ' -f 1)" != "$SHA256" ]; then
+            echo "$(msg log_checksum_mismatch "$PART")" >> /var/log/cron.log
+            return 1
+        fi
+    done
+
+    # マニフェストに記録されたハッシュ値と照合する
+    if [ -n "$MANIFEST" ]; then
+        for PART in $(echo "$MANIFEST" | jq -r '.parts[] | "\(.name):\(.sha256)"'); do
+            if [ "$(sha256sum $VERIFY_DIR/${PART%:*} | cut -d ' ' -f 1)" != "${PART##*:}" ]; then
+                echo "$(msg log_checksum_mismatch "${PART%:*}")" >> /var/log/cron.log
+                return 1
+            fi
+        done
+    fi
+
+    # 暗号化されている場合はAGE_IDENTITYの秘密鍵で復号する (秘密鍵がなければハッシュ値の照合までとする)
+    ARCHIVE=$VERIFY_DIR/$TARGET
+    case "$TARGET" in
+        *.age)
+            if [ -z "$AGE_IDENTITY" ]; then
+                echo "$(msg log_verify_encrypted "$TARGET")" >> /var/log/cron.log
+                return 0
+            fi
+            age -d -i "$AGE_IDENTITY" -o ${ARCHIVE%.age} $ARCHIVE >> /var/log/cron.log 2>&1 || return 1
+            ARCHIVE=${ARCHIVE%.age}
+            ;;
+    esac
+
+    7z t $ARCHIVE >> /var/log/cron.log 2>&1 || return 1
+
+    # ダンプが読み込める状態か確認する
+    # プレーン形式は末尾の完了マーカーを、custom/directory形式はpg_restore --listで目次を確認する
+    case "$ARCHIVE" in
+        *.sql.7z|*.sql.7z.001)
+            7z x -o$EXTRACT_DIR $ARCHIVE > /dev/null 2>&1 || return 1
+            DUMP=$(ls -d $EXTRACT_DIR/* | head -n 1)
+            DUMP_SHA256=$(echo "$MANIFEST" | jq -r '.dump.sha256 // empty' 2> /dev/null)
+            if [ -n "$DUMP_SHA256" ] && [ "$(sha256sum $DUMP | cut -d ' ' -f 1)" != "$DUMP_SHA256" ]; then
+                echo "$(msg log_checksum_mismatch "$(basename $DUMP)")" >> /var/log/cron.log
+                return 1
+            fi
+            if [ -d "$DUMP" ] || [ "$(head -c 5 $DUMP)" = "PGDMP" ]; then
+                pg_restore --list $DUMP > /dev/null 2>> /var/log/cron.log
+            else
+                tail -c 1024 $DUMP | grep -q "PostgreSQL database dump complete"
+            fi
+            if [ $? -ne 0 ]; then
+                echo "$(msg log_verify_dump_incomplete "$TARGET")" >> /var/log/cron.log
+                return 1
+            fi
+            ;;
+    esac
+}
+
+# 検証結果の確認
+if verify_download; then
+    STATUS=0
+    echo "$(msg log_verify_succeeded "$TARGET")" >> /var/log/cron.log
+    if [ -n "$NOTIFICATION" ]; then
+        notify info "$(msg notify_verify_succeeded "$TARGET")"
+    fi
+else
+    STATUS=1
+    echo "$(msg log_verify_failed "$TARGET")" >> /var/log/cron.log
+    if [ -n "$NOTIFICATION" ]; then
+        notify failure "$(msg notify_verify_failed "$TARGET")"
+    fi
+fi
+
+# 実行結果をRESULT_FILEに書き出す
+write_result verify "$(jq -n \
+    --arg target "$TARGET" \
+    --argjson parts "$(echo "${MANIFEST:-null}" | jq '.parts // []' 2> /dev/null || echo '[]')" \
+    '{target: $target, artifacts: $parts}')"
+
+# ダウンロードしたファイルを削除
+rm -rf $VERIFY_DIR/${TARGET%.001}* $VERIFY_DIR/${TARGET%.age}
+rm -rf $EXTRACT_DIR
+find $VERIFY_DIR -mindepth 1 -type d -empty -delete
+
+exit $STATUS
@@ -0,0 +1,47 @@
+#!/bin/sh
+
+# =============================================
+#  統合テスト
+#  Postgres・MinIOのコンテナを起動し、Misskeyに似たスキーマのデータを入れてから
+#  backup.sh → verify.sh → restore.sh --apply を実行し、復元したデータベースが元と一致することを確認します。
+#  使い方: sh test/run.sh  (Docker Composeが必要です。終了時にコンテナとボリュームを削除します)
+# =============================================
+
+set -eu
+
+cd "$(dirname "$0")"
+COMPOSE="docker compose -f compose.yaml -p misskey-backup-test"
+WORK_DIR=$(mktemp -d)
+
+# 失敗した場合はバックアップのログを表示してから片付ける
+finish() {
+    STATUS=$?
+    if [ $STATUS -ne 0 ]; then
+        $COMPOSE exec -T backup cat /var/log/cron.log || true
+        echo "FAILED"
+    fi
+    $COMPOSE down -v > /dev/null 2>&1
+    rm -rf $WORK_DIR
+    exit $STATUS
+}
+trap finish EXIT
+
+$COMPOSE up -d --build --wait
+
+$COMPOSE exec -T postgres psql -U misskey -d misskey -v ON_ERROR_STOP=1 -q < seed.sql
+$COMPOSE exec -T backup rclone mkdir backup:misskey-backup
+
+$COMPOSE exec -T backup sh /root/backup.sh
+$COMPOSE exec -T backup sh /root/verify.sh latest
+$COMPOSE exec -T backup sh /root/restore.sh --apply --clean
+
+# 元のデータベースと復元したデータベースのダンプを比較する
+# (\restrict・\unrestrict の行はダンプごとにランダムな値が入るため除く)
+dump_database() {
+    $COMPOSE exec -T postgres pg_dump -U misskey -d $1 | grep -v -e '^\\restrict ' -e '^\\unrestrict '
+}
+dump_database misskey > $WORK_DIR/source.sql
+dump_database misskey_restore > $WORK_DIR/restored.sql
+diff -u $WORK_DIR/source.sql $WORK_DIR/restored.sql
+
+echo "OK"
@@ -0,0 +1,59 @@
+-- Misskeyのテーブルを簡略化したスキーマとテストデータ
+-- 日本語・絵文字・JSON・配列・NULLなど、ダンプと読み込みで崩れやすい値を含める
+
+CREATE TABLE "user" (
+    "id" varchar(32) PRIMARY KEY,
+    "createdAt" timestamptz NOT NULL,
+    "username" varchar(128) NOT NULL,
+    "usernameLower" varchar(128) NOT NULL,
+    "host" varchar(512),
+    "name" varchar(128),
+    "emojis" varchar(128)[] NOT NULL DEFAULT '{}'
+);
+CREATE UNIQUE INDEX "IDX_user_usernameLower_host" ON "user" ("usernameLower", "host");
+
+CREATE TABLE "drive_file" (
+    "id" varchar(32) PRIMARY KEY,
+    "userId" varchar(32) REFERENCES "user" ("id") ON DELETE CASCADE,
+    "name" varchar(256) NOT NULL,
+    "type" varchar(128) NOT NULL,
+    "size" integer NOT NULL,
+    "properties" jsonb NOT NULL DEFAULT '{}'
+);
+
+CREATE TABLE "note" (
+    "id" varchar(32) PRIMARY KEY,
+    "userId" varchar(32) NOT NULL REFERENCES "user" ("id") ON DELETE CASCADE,
+    "text" text,
+    "cw" varchar(512),
+    "visibility" varchar(16) NOT NULL,
+    "fileIds" varchar(32)[] NOT NULL DEFAULT '{}',
+    "replyId" varchar(32) REFERENCES "note" ("id") ON DELETE CASCADE
+);
+CREATE INDEX "IDX_note_userId" ON "note" ("userId");
+
+CREATE TABLE "following" (
+    "id" varchar(32) PRIMARY KEY,
+    "followerId" varchar(32) NOT NULL REFERENCES "user" ("id") ON DELETE CASCADE,
+    "followeeId" varchar(32) NOT NULL REFERENCES "user" ("id") ON DELETE CASCADE
+);
+
+INSERT INTO "user" VALUES
+    ('9a0000000000000000000001', '2024-05-01 00:00:00+00', 'alice', 'alice', NULL, 'アリス🐈', '{":blobcat:"}'),
+    ('9a0000000000000000000002', '2024-05-01 00:01:00+00', 'bob', 'bob', 'remote.example', NULL, '{}');
+
+INSERT INTO "drive_file" VALUES
+    ('9b0000000000000000000001', '9a0000000000000000000001', 'cat.png', 'image/png', 12345,
+     '{"width": 640, "height": 480}');
+
+INSERT INTO "note"
+SELECT '9c' || lpad(i::text, 22, '0'), '9a0000000000000000000001',
+       'ノート ' || i || E'\nタブ\tと改行を含む本文 ''引用符'' 🎉', NULL, 'public', '{}', NULL
+FROM generate_series(1, 1000) AS i;
+
+INSERT INTO "note" VALUES
+    ('9d0000000000000000000001', '9a0000000000000000000002', NULL, 'CW', 'home',
+     '{"9b0000000000000000000001"}', '9c0000000000000000000001');
+
+INSERT INTO "following" VALUES
+    ('9e0000000000000000000001', '9a0000000000000000000002', '9a0000000000000000000001');